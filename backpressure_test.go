@@ -0,0 +1,101 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	"google.golang.org/protobuf/proto"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackpressure(t *testing.T) {
+	for _, name := range queue.Patterns() {
+		if name == "none" {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, queue.Config{})
+			// Patterns which send immediately hold the request in flight instead
+			s.SetDelay(func([]string) time.Duration { return 200 * time.Millisecond })
+
+			p, err := queue.New(name, queue.BatcherConfig{
+				Client: s.Client(t),
+				// Only room for a single request in the queue
+				MaxQueuedBytes: proto.Size(produceRequest("item-0")),
+				// Ensure interval based patterns never flush before Close()
+				FlushInterval: time.Minute,
+			})
+			require.NoError(t, err)
+			tp, ok := p.(queue.TryProducer)
+			require.True(t, ok)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, p.ProduceItems(ctx, produceRequest("item-0")))
+			}()
+
+			// Wait for the producer to queue the request
+			time.Sleep(100 * time.Millisecond)
+
+			err = tp.TryProduceItems(ctx, produceRequest("item-1"))
+			assert.True(t, errors.Is(err, queue.ErrQueueFull))
+
+			// A blocking producer waits for room until ctx is done
+			waitCtx, waitCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer waitCancel()
+			err = p.ProduceItems(waitCtx, produceRequest("item-2"))
+			assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+			require.NoError(t, p.Close(ctx))
+			wg.Wait()
+			assert.Equal(t, []string{"item-0"}, s.Items())
+		})
+	}
+}
+
+func TestBackpressureWait(t *testing.T) {
+	for _, name := range queue.Patterns() {
+		if name == "none" {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, queue.Config{})
+
+			p, err := queue.New(name, queue.BatcherConfig{
+				Client:         s.Client(t),
+				MaxQueuedBytes: proto.Size(produceRequest("item-0")),
+				FlushInterval:  10 * time.Millisecond,
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			// Each producer must wait for the previous request to be sent
+			var wg sync.WaitGroup
+			for _, item := range []string{"item-0", "item-1", "item-2"} {
+				wg.Add(1)
+				go func(item string) {
+					defer wg.Done()
+					assert.NoError(t, p.ProduceItems(ctx, produceRequest(item)))
+				}(item)
+			}
+			wg.Wait()
+
+			require.NoError(t, p.Close(ctx))
+			assert.Len(t, s.Items(), 3)
+			assert.Len(t, s.Batches(), 3)
+		})
+	}
+}
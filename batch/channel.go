@@ -0,0 +1,105 @@
+package batch
+
+import (
+	"context"
+	"github.com/thrawn01/queue-patterns.go/interval"
+	"math"
+	"sync"
+)
+
+// channelQueue implements the Channel strategy
+type channelQueue[T any] struct {
+	ch       chan T
+	wg       sync.WaitGroup
+	done     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	closeMu  sync.RWMutex
+	closeCtx context.Context
+	closed   bool
+	conf     QueueConfig[T]
+}
+
+func newChannelQueue[T any](conf QueueConfig[T]) *channelQueue[T] {
+	m := &channelQueue[T]{
+		ch:   make(chan T, conf.BufferSize),
+		done: make(chan struct{}),
+		conf: conf,
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	m.wg.Add(1)
+	go m.run()
+
+	return m
+}
+
+func (m *channelQueue[T]) run() {
+	defer m.wg.Done()
+	batch := make([]T, 0, m.conf.Limit)
+
+	// In linger mode the interval never ticks, instead each batch is flushed
+	// once it is full or the first value has lingered MaxLinger.
+	var i *interval.Interval
+	var tickC chan struct{}
+	if !m.conf.lingering() {
+		i = m.conf.newInterval()
+		defer i.Stop()
+		i.Next()
+		tickC = i.C
+	}
+
+	for {
+		select {
+		// Collect all the values into a local batch
+		case v := <-m.ch:
+			batch = append(batch, v)
+			if m.conf.lingering() {
+				batch = m.conf.Linger(m.ch, m.done, batch, m.conf.queued(batch[0]), math.MaxInt)
+				batch = m.flush(m.ctx, batch, m.conf.reason(batch, math.MaxInt))
+			}
+
+		// Once every tick flush all the values in a batch
+		case <-tickC:
+			batch = m.flush(m.ctx, batch, ReasonTick)
+			i.Next()
+		case <-m.done:
+			m.flush(m.closeCtx, Drain(m.ch, batch, math.MaxInt), ReasonClose)
+			return
+		}
+	}
+}
+
+// flush passes the batch to conf.Flush and returns the batch emptied for reuse
+func (m *channelQueue[T]) flush(ctx context.Context, batch []T, reason Reason) []T {
+	if len(batch) == 0 {
+		return batch
+	}
+	m.conf.Flush(ctx, batch, reason)
+	clear(batch)
+	return batch[:0]
+}
+
+func (m *channelQueue[T]) put(ctx context.Context, v T, block bool) error {
+	m.closeMu.RLock()
+	defer m.closeMu.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+	return Send(ctx, m.ch, v, block)
+}
+
+func (m *channelQueue[T]) close(ctx context.Context) error {
+	m.closeMu.Lock()
+	if m.closed {
+		m.closeMu.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	m.closeMu.Unlock()
+
+	m.closeCtx = ctx
+	close(m.done)
+	Wait(ctx, &m.wg, m.cancel)
+	return ctx.Err()
+}
@@ -0,0 +1,118 @@
+package batch
+
+import (
+	"github.com/kapetan-io/tackle/clock"
+	"github.com/thrawn01/queue-patterns.go/interval"
+	"time"
+)
+
+// lingering returns true if linger mode is enabled
+func (c *QueueConfig[T]) lingering() bool {
+	return c.MaxLinger > 0
+}
+
+// size returns the number of items and bytes the value adds to a batch
+func (c *QueueConfig[T]) size(v T) (items, bytes int) {
+	if c.Size == nil {
+		return 1, 0
+	}
+	return c.Size(v)
+}
+
+// queued returns when the value was queued, or the current time if the queue does
+// not know when it was queued
+func (c *QueueConfig[T]) queued(v T) time.Time {
+	if c.Queued == nil {
+		return clock.Now()
+	}
+	return c.Queued(v)
+}
+
+// batchSize returns the total number of items and bytes of the values in the batch
+func (c *QueueConfig[T]) batchSize(batch []T) (items, bytes int) {
+	for _, v := range batch {
+		i, b := c.size(v)
+		items += i
+		bytes += b
+	}
+	return items, bytes
+}
+
+// full returns true if the items and bytes collected should be flushed without
+// waiting for the interval or linger to expire.
+func (c *QueueConfig[T]) full(items, bytes int) bool {
+	return items >= c.MinItems || (c.MinBytes != 0 && bytes >= c.MinBytes)
+}
+
+// reason returns why a batch collected by a writer which flushes as soon as it is
+// able to was flushed
+func (c *QueueConfig[T]) reason(batch []T, limit int) Reason {
+	if len(batch) >= limit || c.full(c.batchSize(batch)) {
+		return ReasonSize
+	}
+	if c.lingering() {
+		return ReasonTick
+	}
+	return ReasonDrain
+}
+
+// newInterval returns the interval which flushes the values collected
+func (c *QueueConfig[T]) newInterval() *interval.Interval {
+	if c.FixedRate {
+		return interval.NewFixedInterval(c.FlushInterval)
+	}
+	return interval.NewInterval(c.FlushInterval)
+}
+
+// lingerRemaining returns how long until a batch started at the provided time has
+// lingered MaxLinger
+func (c *QueueConfig[T]) lingerRemaining(started time.Time) time.Duration {
+	return c.MaxLinger - clock.Since(started)
+}
+
+// lingerTimer returns the timer Linger waits on, which expires after d. The timer
+// is created by the first call and reset by each call after.
+func (c *QueueConfig[T]) lingerTimer(d time.Duration) clock.Timer {
+	if c.timer == nil {
+		c.timer = clock.NewTimer(d)
+		return c.timer
+	}
+	c.timer.Reset(d)
+	return c.timer
+}
+
+// Linger collects values from the channel until the batch is full, MaxLinger has
+// passed since started, the batch reaches limit values, or done is closed. started
+// is when the oldest value in the batch was queued. As Linger reuses its timer, it
+// must not be called concurrently with the same config.
+func (c *QueueConfig[T]) Linger(ch chan T, done chan struct{}, batch []T,
+	started time.Time, limit int) []T {
+
+	items, bytes := c.batchSize(batch)
+	timer := c.lingerTimer(c.lingerRemaining(started))
+	defer func() {
+		// The timer may have expired without being received, which the next call
+		// must not receive once the timer is reset.
+		if !timer.Stop() {
+			select {
+			case <-timer.C():
+			default:
+			}
+		}
+	}()
+
+	for !c.full(items, bytes) && len(batch) < limit {
+		select {
+		case v := <-ch:
+			batch = append(batch, v)
+			i, b := c.size(v)
+			items += i
+			bytes += b
+		case <-timer.C():
+			return batch
+		case <-done:
+			return batch
+		}
+	}
+	return batch
+}
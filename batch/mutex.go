@@ -0,0 +1,191 @@
+package batch
+
+import (
+	"context"
+	"github.com/kapetan-io/tackle/clock"
+	"sync"
+	"time"
+)
+
+// mutexQueue implements the Mutex strategy. When the batch is full, or the interval
+// ticks, the batch is swapped for a recycled buffer while holding the mutex and the
+// swapped batch is flushed by run() outside the mutex, such that producers are never
+// blocked by the flush.
+type mutexQueue[T any] struct {
+	mutex sync.Mutex
+	batch []T
+	items int
+	bytes int
+	// started is when the first value in the batch was queued
+	started time.Time
+	// pending are batches swapped out waiting to be flushed in order, and reasons
+	// the reason each pending batch was swapped
+	pending [][]T
+	reasons []Reason
+	// free are buffers from flushed batches which are recycled as the next batch
+	free     [][]T
+	closed   bool
+	notifyCh chan struct{}
+	wg       sync.WaitGroup
+	done     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	conf     QueueConfig[T]
+}
+
+func newMutexQueue[T any](conf QueueConfig[T]) *mutexQueue[T] {
+	m := &mutexQueue[T]{
+		batch:    make([]T, 0, conf.Limit),
+		notifyCh: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		conf:     conf,
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	m.wg.Add(1)
+	go m.run()
+
+	return m
+}
+
+// swap moves the current batch to the pending batches and replaces it with a
+// recycled buffer. The caller must hold the mutex.
+func (m *mutexQueue[T]) swap(reason Reason) {
+	if len(m.batch) == 0 {
+		return
+	}
+	m.pending = append(m.pending, m.batch)
+	m.reasons = append(m.reasons, reason)
+
+	if len(m.free) != 0 {
+		m.batch = m.free[len(m.free)-1]
+		m.free = m.free[:len(m.free)-1]
+	} else {
+		m.batch = make([]T, 0, m.conf.Limit)
+	}
+	m.items, m.bytes = 0, 0
+}
+
+// flushPending flushes all the pending batches in the order they were swapped
+func (m *mutexQueue[T]) flushPending(ctx context.Context) {
+	m.mutex.Lock()
+	pending, reasons := m.pending, m.reasons
+	m.pending, m.reasons = nil, nil
+	m.mutex.Unlock()
+
+	for i, batch := range pending {
+		m.conf.Flush(ctx, batch, reasons[i])
+		clear(batch)
+
+		// Double buffering only ever needs a couple of spare buffers
+		m.mutex.Lock()
+		if len(m.free) < 2 {
+			m.free = append(m.free, batch[:0])
+		}
+		m.mutex.Unlock()
+	}
+}
+
+// put never blocks, as the batch is never full
+func (m *mutexQueue[T]) put(_ context.Context, v T, _ bool) error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return ErrClosed
+	}
+	if len(m.batch) == 0 {
+		m.started = m.conf.queued(v)
+	}
+	m.batch = append(m.batch, v)
+	items, bytes := m.conf.size(v)
+	m.items += items
+	m.bytes += bytes
+	full := m.conf.full(m.items, m.bytes)
+	if full {
+		m.swap(ReasonSize)
+	}
+	m.mutex.Unlock()
+
+	// Wake run() to flush the full batch
+	if full {
+		select {
+		case m.notifyCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (m *mutexQueue[T]) run() {
+	defer m.wg.Done()
+	if m.conf.lingering() {
+		m.runLinger()
+		return
+	}
+
+	i := m.conf.newInterval()
+	defer i.Stop()
+	i.Next()
+
+	for {
+		select {
+		case <-i.C:
+			m.mutex.Lock()
+			m.swap(ReasonTick)
+			m.mutex.Unlock()
+			m.flushPending(m.ctx)
+			i.Next()
+		case <-m.notifyCh:
+			m.flushPending(m.ctx)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// runLinger flushes the batch once it is full or MaxLinger has passed since the
+// first value in the batch was queued.
+func (m *mutexQueue[T]) runLinger() {
+	timer := clock.NewTimer(m.conf.MaxLinger)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C():
+			m.mutex.Lock()
+			wait := m.conf.MaxLinger
+			if len(m.batch) != 0 {
+				if wait = m.conf.lingerRemaining(m.started); wait <= 0 {
+					m.swap(ReasonTick)
+					wait = m.conf.MaxLinger
+				}
+			}
+			m.mutex.Unlock()
+			m.flushPending(m.ctx)
+			timer.Reset(wait)
+		case <-m.notifyCh:
+			m.flushPending(m.ctx)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *mutexQueue[T]) close(ctx context.Context) error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	m.mutex.Unlock()
+
+	close(m.done)
+	Wait(ctx, &m.wg, m.cancel)
+
+	m.mutex.Lock()
+	m.swap(ReasonClose)
+	m.mutex.Unlock()
+	m.flushPending(ctx)
+	return ctx.Err()
+}
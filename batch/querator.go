@@ -0,0 +1,87 @@
+package batch
+
+import (
+	"context"
+	"sync"
+)
+
+// queratorQueue implements the Querator strategy
+type queratorQueue[T any] struct {
+	ch       chan T
+	wg       sync.WaitGroup
+	done     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	closeMu  sync.RWMutex
+	closeCtx context.Context
+	closed   bool
+	conf     QueueConfig[T]
+}
+
+func newQueratorQueue[T any](conf QueueConfig[T]) *queratorQueue[T] {
+	m := &queratorQueue[T]{
+		ch:   make(chan T, conf.BufferSize),
+		done: make(chan struct{}),
+		conf: conf,
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	m.wg.Add(1)
+	go m.run()
+
+	return m
+}
+
+func (m *queratorQueue[T]) run() {
+	defer m.wg.Done()
+	batch := make([]T, 0, m.conf.Limit)
+
+	for {
+		select {
+		// Collect everything waiting in the channel into a batch
+		case v := <-m.ch:
+			batch = append(batch, v)
+			batch = Drain(m.ch, batch, m.conf.Limit)
+			if m.conf.lingering() {
+				batch = m.conf.Linger(m.ch, m.done, batch, m.conf.queued(batch[0]), m.conf.Limit)
+			}
+
+			m.conf.Flush(m.ctx, batch, m.conf.reason(batch, m.conf.Limit))
+			clear(batch)
+			batch = batch[:0]
+		case <-m.done:
+			for {
+				batch = Drain(m.ch, batch[:0], m.conf.Limit)
+				if len(batch) == 0 {
+					return
+				}
+				m.conf.Flush(m.closeCtx, batch, ReasonClose)
+				clear(batch)
+			}
+		}
+	}
+}
+
+func (m *queratorQueue[T]) put(ctx context.Context, v T, block bool) error {
+	m.closeMu.RLock()
+	defer m.closeMu.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+	return Send(ctx, m.ch, v, block)
+}
+
+func (m *queratorQueue[T]) close(ctx context.Context) error {
+	m.closeMu.Lock()
+	if m.closed {
+		m.closeMu.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	m.closeMu.Unlock()
+
+	m.closeCtx = ctx
+	close(m.done)
+	Wait(ctx, &m.wg, m.cancel)
+	return ctx.Err()
+}
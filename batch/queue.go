@@ -0,0 +1,270 @@
+// Package batch collects values produced by many goroutines into batches, such
+// that each batch can be written with a single round trip. The Queue collects
+// values using one of several strategies and passes each batch to Flush. The
+// values carry whatever a caller needs to receive its result, as the requests of
+// the queue package do.
+package batch
+
+import (
+	"context"
+	"errors"
+	"github.com/kapetan-io/tackle/clock"
+	"github.com/kapetan-io/tackle/set"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrClosed is returned when a value is queued after Close
+	ErrClosed = errors.New("queue is closed")
+	// ErrQueueFull is returned by TryPut when there is no room in the queue
+	ErrQueueFull = errors.New("queue is full")
+)
+
+const (
+	DefaultLimit         = 1000
+	DefaultFlushInterval = 15 * clock.Millisecond
+)
+
+// Strategy is the method used to collect values into a batch
+type Strategy int
+
+const (
+	// Mutex appends each value to a slice protected by a mutex. The slice is
+	// swapped for a spare buffer once full or when the interval ticks, and the
+	// swapped batch is flushed outside the mutex.
+	Mutex Strategy = iota
+	// Channel sends each value over a buffered channel to a writer which
+	// collects them into a batch until the interval ticks.
+	Channel
+	// Querator sends each value over a buffered channel to a writer which
+	// flushes everything waiting in the channel as soon as it is able to.
+	Querator
+	// Ring publishes each value into a lock free ring buffer which a writer
+	// flushes as soon as it is able to.
+	Ring
+	// Striped appends each value to one of several buffers, each protected by its
+	// own mutex and chosen by a hint of the P the producer is running on. The
+	// writer sweeps every buffer when the interval ticks, or once any buffer
+	// holds its share of a full batch.
+	Striped
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case Mutex:
+		return "mutex"
+	case Channel:
+		return "channel"
+	case Querator:
+		return "querator"
+	case Ring:
+		return "ring"
+	case Striped:
+		return "striped"
+	}
+	return "unknown"
+}
+
+// Reason is why a batch was flushed
+type Reason int
+
+const (
+	// ReasonSize is a batch flushed because it was full
+	ReasonSize Reason = iota
+	// ReasonTick is a batch flushed because the interval ticked, or the first value
+	// in the batch lingered MaxLinger
+	ReasonTick
+	// ReasonDrain is a batch flushed as soon as the writer was able to, holding
+	// everything which was waiting in the queue
+	ReasonDrain
+	// ReasonClose is a batch flushed by Close
+	ReasonClose
+)
+
+func (r Reason) String() string {
+	switch r {
+	case ReasonSize:
+		return "size"
+	case ReasonTick:
+		return "tick"
+	case ReasonDrain:
+		return "drain"
+	case ReasonClose:
+		return "close"
+	}
+	return "unknown"
+}
+
+type QueueConfig[T any] struct {
+	// Flush is called with each batch collected and the reason it was flushed. Flush
+	// is never called concurrently and must not retain the batch after it returns.
+	Flush func(ctx context.Context, batch []T, reason Reason)
+	// Strategy is the method used to collect values into a batch (Default: Mutex)
+	Strategy Strategy
+	// Limit is the maximum number of values the Querator strategy collects into a
+	// single batch (Default: 1000)
+	Limit int
+	// BufferSize is the capacity of the channel or ring values are placed into
+	// before the writer collects them (Default: Limit)
+	BufferSize int
+	// FlushInterval is how often the Mutex and Channel strategies flush the values
+	// collected. (Default: 15ms)
+	FlushInterval clock.Duration
+	// FixedRate causes the Mutex and Channel strategies to flush every FlushInterval
+	// on a fixed rate which keeps its phase, instead of waiting FlushInterval after
+	// each flush completes.
+	FixedRate bool
+	// MaxLinger enables linger mode when greater than zero. In linger mode, the interval
+	// is not used. Instead, a batch is flushed as soon as it is full, or once MaxLinger
+	// has passed since the oldest value in the batch was queued.
+	MaxLinger clock.Duration
+	// Queued returns when the value was queued. (Default: when the value was put, or
+	// collected by the writer of the Channel, Querator and Ring strategies)
+	Queued func(v T) time.Time
+	// Size returns the number of items and bytes a value adds to a batch. (Default: one
+	// item and zero bytes)
+	Size func(v T) (items, bytes int)
+	// MinItems is the number of items which fills a batch (Default: Limit)
+	MinItems int
+	// MinBytes is the number of bytes which fills a batch. Zero disables the limit.
+	MinBytes int
+	// Stripes is the number of buffers the Striped strategy collects values into
+	// (Default: runtime.GOMAXPROCS(0))
+	Stripes int
+	// timer is reused by each call to Linger
+	timer clock.Timer
+}
+
+func (c *QueueConfig[T]) validate() error {
+	set.Default(&c.Limit, DefaultLimit)
+	set.Default(&c.BufferSize, c.Limit)
+	set.Default(&c.FlushInterval, DefaultFlushInterval)
+	set.Default(&c.MinItems, c.Limit)
+	set.Default(&c.Stripes, runtime.GOMAXPROCS(0))
+
+	if c.Flush == nil {
+		return errors.New("conf.Flush cannot be nil")
+	}
+	if c.Strategy < Mutex || c.Strategy > Striped {
+		return errors.New("conf.Strategy is invalid")
+	}
+	if c.Limit < 0 {
+		return errors.New("conf.Limit is invalid; must be greater than zero")
+	}
+	if c.BufferSize < 0 {
+		return errors.New("conf.BufferSize is invalid; must be greater than zero")
+	}
+	if c.MaxLinger < 0 {
+		return errors.New("conf.MaxLinger is invalid; must be greater than zero")
+	}
+	if c.MinItems < 0 || c.MinBytes < 0 {
+		return errors.New("conf.MinItems and conf.MinBytes must be greater than zero")
+	}
+	if c.Stripes < 0 {
+		return errors.New("conf.Stripes is invalid; must be greater than zero")
+	}
+	return nil
+}
+
+// strategy is implemented by each method of collecting values into a batch
+type strategy[T any] interface {
+	put(ctx context.Context, v T, block bool) error
+	close(ctx context.Context) error
+}
+
+// Queue collects values into batches using the configured Strategy and passes
+// each batch to conf.Flush
+type Queue[T any] struct {
+	s strategy[T]
+}
+
+func NewQueue[T any](conf QueueConfig[T]) (*Queue[T], error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+
+	switch conf.Strategy {
+	case Channel:
+		return &Queue[T]{s: newChannelQueue(conf)}, nil
+	case Querator:
+		return &Queue[T]{s: newQueratorQueue(conf)}, nil
+	case Ring:
+		return &Queue[T]{s: newRingQueue(conf)}, nil
+	case Striped:
+		return &Queue[T]{s: newStripedQueue(conf)}, nil
+	}
+	return &Queue[T]{s: newMutexQueue(conf)}, nil
+}
+
+// Put queues the value to be flushed in a future batch. If the queue is full, Put
+// waits for room until ctx is done. The Mutex and Striped strategies are never full.
+func (q *Queue[T]) Put(ctx context.Context, v T) error {
+	return q.s.put(ctx, v, true)
+}
+
+// TryPut is identical to Put except it returns ErrQueueFull instead of waiting
+// for room when the queue is full.
+func (q *Queue[T]) TryPut(v T) error {
+	return q.s.put(context.Background(), v, false)
+}
+
+// Len returns the number of values queued which are yet to be collected for a
+// flush, or false if the strategy does not count them. Only the Striped strategy
+// counts the values queued, as it does so without contending with producers.
+func (q *Queue[T]) Len() (int, bool) {
+	if l, ok := q.s.(interface{ len() int }); ok {
+		return l.len(), true
+	}
+	return 0, false
+}
+
+// Close stops accepting new values and flushes any values already queued with
+// the provided ctx. Returns ErrClosed if already closed.
+func (q *Queue[T]) Close(ctx context.Context) error {
+	return q.s.close(ctx)
+}
+
+// Wait waits for the writers in wg to return. If ctx is done first, cancel is called
+// such that the writers give up on the batch they are flushing, as the ctx of each
+// batch flushed before Close is derived from the ctx cancel belongs to.
+func Wait(ctx context.Context, wg *sync.WaitGroup, cancel context.CancelFunc) {
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+	wg.Wait()
+}
+
+// Send places the value on the channel. If block is false, ErrQueueFull is returned
+// when the channel is full, else Send waits for room in the channel until ctx is done.
+func Send[T any](ctx context.Context, ch chan T, v T, block bool) error {
+	if !block {
+		select {
+		case ch <- v:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	}
+
+	select {
+	case ch <- v:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Drain appends the values currently buffered in the channel to the batch without
+// blocking, until the batch holds limit values.
+func Drain[T any](ch chan T, batch []T, limit int) []T {
+	for len(batch) < limit {
+		select {
+		case v := <-ch:
+			batch = append(batch, v)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
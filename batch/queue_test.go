@@ -0,0 +1,332 @@
+package batch_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/kapetan-io/tackle/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go/batch"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+var strategies = []batch.Strategy{batch.Mutex, batch.Channel, batch.Querator, batch.Ring, batch.Striped}
+
+// recorder records every value passed to Flush
+type recorder struct {
+	mutex  sync.Mutex
+	values []int
+}
+
+func (r *recorder) Flush(_ context.Context, values []int, _ batch.Reason) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.values = append(r.values, values...)
+}
+
+func (r *recorder) Values() []int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]int(nil), r.values...)
+}
+
+func TestQueueClose(t *testing.T) {
+	for _, s := range strategies {
+		t.Run(s.String(), func(t *testing.T) {
+			var r recorder
+			q, err := batch.NewQueue(batch.QueueConfig[int]{
+				Flush:    r.Flush,
+				Strategy: s,
+				// Ensure interval based strategies never flush before Close()
+				FlushInterval: time.Minute,
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			for i := 0; i < 10; i++ {
+				require.NoError(t, q.Put(ctx, i))
+			}
+			require.NoError(t, q.Close(ctx))
+			assert.ElementsMatch(t, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, r.Values())
+			assert.ErrorIs(t, q.Put(ctx, 10), batch.ErrClosed)
+		})
+	}
+}
+
+func TestQueueTryPut(t *testing.T) {
+	for _, s := range strategies {
+		// The Mutex and Striped strategies are never full
+		if s == batch.Mutex || s == batch.Striped {
+			continue
+		}
+
+		t.Run(s.String(), func(t *testing.T) {
+			var r recorder
+			unblock := make(chan struct{})
+			flushing := make(chan struct{}, 1)
+
+			q, err := batch.NewQueue(batch.QueueConfig[int]{
+				Flush: func(ctx context.Context, values []int, reason batch.Reason) {
+					select {
+					case flushing <- struct{}{}:
+					default:
+					}
+					<-unblock
+					r.Flush(ctx, values, reason)
+				},
+				Strategy:      s,
+				BufferSize:    2,
+				FlushInterval: 5 * time.Millisecond,
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			// Block the writer in Flush, then fill the buffer
+			require.NoError(t, q.Put(ctx, 0))
+			<-flushing
+			require.NoError(t, q.Put(ctx, 1))
+			require.NoError(t, q.Put(ctx, 2))
+			assert.ErrorIs(t, q.TryPut(3), batch.ErrQueueFull)
+
+			close(unblock)
+			require.NoError(t, q.Close(ctx))
+			assert.ElementsMatch(t, []int{0, 1, 2}, r.Values())
+		})
+	}
+}
+
+func TestQueueLinger(t *testing.T) {
+	for _, s := range strategies {
+		t.Run(s.String(), func(t *testing.T) {
+			var mutex sync.Mutex
+			var batches [][]string
+			var reasons []batch.Reason
+			flushed := make(chan struct{}, 10)
+
+			q, err := batch.NewQueue(batch.QueueConfig[string]{
+				Flush: func(_ context.Context, b []string, reason batch.Reason) {
+					mutex.Lock()
+					batches = append(batches, append([]string(nil), b...))
+					reasons = append(reasons, reason)
+					mutex.Unlock()
+					flushed <- struct{}{}
+				},
+				Strategy:  s,
+				MaxLinger: 200 * time.Millisecond,
+				// Each value counts as two items
+				Size:     func(string) (int, int) { return 2, 0 },
+				MinItems: 10,
+			})
+			require.NoError(t, err)
+			defer func() { _ = q.Close(context.Background()) }()
+
+			// The batch is flushed as soon as it is full
+			start := time.Now()
+			for _, v := range []string{"a", "b", "c", "d", "e"} {
+				require.NoError(t, q.Put(context.Background(), v))
+			}
+			<-flushed
+			assert.Less(t, time.Since(start), 150*time.Millisecond)
+
+			// The batch is flushed once it has lingered MaxLinger
+			start = time.Now()
+			require.NoError(t, q.Put(context.Background(), "linger"))
+			<-flushed
+			assert.GreaterOrEqual(t, time.Since(start), 190*time.Millisecond)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			require.Len(t, batches, 2)
+			assert.Equal(t, []string{"a", "b", "c", "d", "e"}, batches[0])
+			assert.Equal(t, []string{"linger"}, batches[1])
+			assert.Equal(t, []batch.Reason{batch.ReasonSize, batch.ReasonTick}, reasons)
+		})
+	}
+}
+
+func TestQueueLingerBusy(t *testing.T) {
+	type value struct {
+		name   string
+		queued time.Time
+	}
+
+	for _, s := range strategies {
+		t.Run(s.String(), func(t *testing.T) {
+			flushed := make(chan string, 10)
+			busy := make(chan struct{})
+
+			q, err := batch.NewQueue(batch.QueueConfig[value]{
+				Flush: func(_ context.Context, b []value, _ batch.Reason) {
+					// Keep the writer busy while the next value waits in the queue
+					if b[0].name == "busy" {
+						close(busy)
+						time.Sleep(150 * time.Millisecond)
+					}
+					flushed <- b[0].name
+				},
+				Strategy:  s,
+				MaxLinger: 200 * time.Millisecond,
+				// The busy value fills a batch on its own
+				Size: func(v value) (int, int) {
+					if v.name == "busy" {
+						return 10, 0
+					}
+					return 1, 0
+				},
+				MinItems: 10,
+				Queued:   func(v value) time.Time { return v.queued },
+			})
+			require.NoError(t, err)
+			defer func() { _ = q.Close(context.Background()) }()
+
+			require.NoError(t, q.Put(context.Background(), value{name: "busy", queued: time.Now()}))
+			<-busy
+			start := time.Now()
+			require.NoError(t, q.Put(context.Background(), value{name: "late", queued: start}))
+			assert.Equal(t, "busy", <-flushed)
+
+			// The late value lingers MaxLinger from when it was queued, not from when
+			// the writer was done with the busy batch
+			assert.Equal(t, "late", <-flushed)
+			assert.GreaterOrEqual(t, time.Since(start), 190*time.Millisecond)
+			assert.Less(t, time.Since(start), 300*time.Millisecond)
+		})
+	}
+}
+
+func TestQueueInterval(t *testing.T) {
+	for _, fixed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("fixed=%t", fixed), func(t *testing.T) {
+			defer clock.Freeze(clock.Now()).UnFreeze()
+			flushed := make(chan []string, 10)
+
+			q, err := batch.NewQueue(batch.QueueConfig[string]{
+				Flush: func(_ context.Context, b []string, reason batch.Reason) {
+					assert.Equal(t, batch.ReasonTick, reason)
+					flushed <- append([]string(nil), b...)
+				},
+				Strategy:      batch.Mutex,
+				FlushInterval: 10 * clock.Millisecond,
+				FixedRate:     fixed,
+			})
+			require.NoError(t, err)
+			defer func() { _ = q.Close(context.Background()) }()
+
+			// Wait for the writer to start the interval
+			require.True(t, clock.Wait4Scheduled(1, time.Second))
+			require.NoError(t, q.Put(context.Background(), "a"))
+
+			clock.Advance(9 * clock.Millisecond)
+			assert.Empty(t, flushed)
+
+			// The batch is flushed once the interval ticks
+			clock.Advance(clock.Millisecond)
+			select {
+			case b := <-flushed:
+				assert.Equal(t, []string{"a"}, b)
+			case <-clock.Realtime().After(time.Second):
+				require.Fail(t, "timeout waiting for flush")
+			}
+		})
+	}
+}
+
+func TestQueueRingFull(t *testing.T) {
+	var mutex sync.Mutex
+	var values []string
+	unblock := make(chan struct{})
+	flushing := make(chan struct{}, 1)
+
+	q, err := batch.NewQueue(batch.QueueConfig[string]{
+		Flush: func(_ context.Context, b []string, _ batch.Reason) {
+			select {
+			case flushing <- struct{}{}:
+			default:
+			}
+			<-unblock
+			mutex.Lock()
+			values = append(values, b...)
+			mutex.Unlock()
+		},
+		Strategy:   batch.Ring,
+		BufferSize: 2,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Block the writer in Flush, then fill the ring
+	require.NoError(t, q.Put(ctx, "a"))
+	<-flushing
+	require.NoError(t, q.Put(ctx, "b"))
+	require.NoError(t, q.Put(ctx, "c"))
+
+	// A producer waiting for room gives up once its context is done
+	short, shortCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer shortCancel()
+	start := time.Now()
+	assert.ErrorIs(t, q.Put(short, "d"), context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// A producer waiting for room wakes once the writer releases a slot
+	done := make(chan error, 1)
+	go func() { done <- q.Put(ctx, "e") }()
+	close(unblock)
+	require.NoError(t, <-done)
+
+	require.NoError(t, q.Close(ctx))
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"a", "b", "c", "e"}, values)
+}
+
+func TestQueueStripedOrder(t *testing.T) {
+	// Every value is put at the same time
+	defer clock.Freeze(clock.Now()).UnFreeze()
+	var values []int
+
+	q, err := batch.NewQueue(batch.QueueConfig[int]{
+		Flush: func(_ context.Context, b []int, _ batch.Reason) {
+			values = append(values, b...)
+		},
+		Strategy: batch.Striped,
+		Stripes:  2,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		// Clearing the cached tokens moves the producer to the next stripe
+		if i%5 == 0 {
+			runtime.GC()
+			runtime.GC()
+		}
+		require.NoError(t, q.Put(context.Background(), i))
+	}
+
+	require.NoError(t, q.Close(context.Background()))
+	for i, v := range values {
+		require.Equal(t, i, v, "values out of order")
+	}
+	assert.Len(t, values, 20)
+}
+
+func TestQueueConfig(t *testing.T) {
+	_, err := batch.NewQueue(batch.QueueConfig[string]{})
+	require.Error(t, err)
+	assert.Equal(t, "conf.Flush cannot be nil", err.Error())
+
+	_, err = batch.NewQueue(batch.QueueConfig[string]{
+		Flush:    func(context.Context, []string, batch.Reason) {},
+		Strategy: batch.Strategy(100),
+	})
+	require.Error(t, err)
+	assert.Equal(t, "conf.Strategy is invalid", err.Error())
+}
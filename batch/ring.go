@@ -0,0 +1,225 @@
+package batch
+
+import (
+	"context"
+	"github.com/kapetan-io/tackle/clock"
+	"sync"
+	"sync/atomic"
+)
+
+// ringSlot is a single slot in the ring. The `seq` field tracks the state of the
+// slot. When seq == pos the slot is free and can be claimed by the producer who
+// claims position `pos`. When seq == pos+1 the slot has been published and is
+// ready to be consumed by the writer.
+type ringSlot[T any] struct {
+	seq atomic.Uint64
+	v   T
+}
+
+// ringQueue implements the Ring strategy
+type ringQueue[T any] struct {
+	// head is the next position to be claimed by a producer
+	head atomic.Uint64
+	// Avoid false sharing between the head and the rest of the struct
+	_        [56]byte
+	ring     []ringSlot[T]
+	mask     uint64
+	notifyCh chan struct{}
+	// freeCh is installed by producers waiting for the writer to release a slot,
+	// and is closed by the writer once it has released one
+	freeCh   atomic.Pointer[chan struct{}]
+	wg       sync.WaitGroup
+	done     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	closeMu  sync.RWMutex
+	closeCtx context.Context
+	closed   bool
+	conf     QueueConfig[T]
+}
+
+func newRingQueue[T any](conf QueueConfig[T]) *ringQueue[T] {
+	// A ring of one slot cannot tell a published slot from a free slot on the next lap
+	size := max(nextPowerOfTwo(conf.BufferSize), 2)
+	m := &ringQueue[T]{
+		ring:     make([]ringSlot[T], size),
+		mask:     uint64(size - 1),
+		notifyCh: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		conf:     conf,
+	}
+
+	for i := range m.ring {
+		m.ring[i].seq.Store(uint64(i))
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	m.wg.Add(1)
+	go m.run()
+
+	return m
+}
+
+func (m *ringQueue[T]) run() {
+	defer m.wg.Done()
+	batch := make([]T, 0, len(m.ring))
+	var tail uint64
+
+	for {
+		batch = m.collect(&tail, batch)
+		if len(batch) != 0 {
+			if m.conf.lingering() {
+				batch = m.linger(&tail, batch)
+			}
+			m.conf.Flush(m.ctx, batch, m.conf.reason(batch, len(m.ring)))
+			clear(batch)
+			batch = batch[:0]
+			continue
+		}
+
+		select {
+		case <-m.notifyCh:
+		case <-m.done:
+			if batch = m.collect(&tail, batch); len(batch) != 0 {
+				m.conf.Flush(m.closeCtx, batch, ReasonClose)
+			}
+			return
+		}
+	}
+}
+
+// collect appends the contiguous run of published slots starting at tail to the
+// batch, and wakes any producers waiting for the slots it released
+func (m *ringQueue[T]) collect(tail *uint64, batch []T) []T {
+	var zero T
+	n := len(batch)
+	for len(batch) < len(m.ring) {
+		slot := &m.ring[*tail&m.mask]
+		if slot.seq.Load() != *tail+1 {
+			break
+		}
+		batch = append(batch, slot.v)
+		slot.v = zero
+		// Release the slot for the producer on the next lap around the ring
+		slot.seq.Store(*tail + uint64(len(m.ring)))
+		*tail++
+	}
+	if len(batch) != n {
+		if ch := m.freeCh.Swap(nil); ch != nil {
+			close(*ch)
+		}
+	}
+	return batch
+}
+
+// waitFree returns a channel which is closed once the writer releases a slot
+func (m *ringQueue[T]) waitFree() <-chan struct{} {
+	for {
+		if ch := m.freeCh.Load(); ch != nil {
+			return *ch
+		}
+		ch := make(chan struct{})
+		if m.freeCh.CompareAndSwap(nil, &ch) {
+			return ch
+		}
+	}
+}
+
+// linger collects published slots until the batch is full, the oldest value in the
+// batch has lingered MaxLinger, the batch holds as many values as the ring, or the
+// queue is closed.
+func (m *ringQueue[T]) linger(tail *uint64, batch []T) []T {
+	timer := clock.NewTimer(m.conf.lingerRemaining(m.conf.queued(batch[0])))
+	defer timer.Stop()
+
+	for len(batch) < len(m.ring) && !m.conf.full(m.conf.batchSize(batch)) {
+		select {
+		case <-m.notifyCh:
+			batch = m.collect(tail, batch)
+		case <-timer.C():
+			return batch
+		case <-m.done:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (m *ringQueue[T]) put(ctx context.Context, v T, block bool) error {
+	m.closeMu.RLock()
+	if m.closed {
+		m.closeMu.RUnlock()
+		return ErrClosed
+	}
+	if err := m.publish(ctx, v, block); err != nil {
+		m.closeMu.RUnlock()
+		return err
+	}
+	m.closeMu.RUnlock()
+
+	// Wake the writer if it is parked
+	select {
+	case m.notifyCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// publish claims the next position in the ring and publishes the value in its
+// slot. A position is only claimed once its slot is free, such that a producer
+// never owns a slot it must wait on and can give up when the ring is full.
+func (m *ringQueue[T]) publish(ctx context.Context, v T, block bool) error {
+	for {
+		pos := m.head.Load()
+		slot := &m.ring[pos&m.mask]
+
+		if slot.seq.Load() == pos {
+			if m.head.CompareAndSwap(pos, pos+1) {
+				slot.v = v
+				slot.seq.Store(pos + 1)
+				return nil
+			}
+			// Another producer claimed the position first
+			continue
+		}
+
+		// The ring is full, wait for the writer to release the slot
+		if !block {
+			return ErrQueueFull
+		}
+		free := m.waitFree()
+		// The writer may have released the slot before the channel was installed
+		if slot.seq.Load() == pos || m.head.Load() != pos {
+			continue
+		}
+		select {
+		case <-free:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (m *ringQueue[T]) close(ctx context.Context) error {
+	m.closeMu.Lock()
+	if m.closed {
+		m.closeMu.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	m.closeMu.Unlock()
+
+	m.closeCtx = ctx
+	close(m.done)
+	Wait(ctx, &m.wg, m.cancel)
+	return ctx.Err()
+}
+
+// nextPowerOfTwo returns the smallest power of two greater than or equal to n
+func nextPowerOfTwo(n int) int {
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	return size
+}
@@ -0,0 +1,266 @@
+package batch
+
+import (
+	"cmp"
+	"context"
+	"github.com/kapetan-io/tackle/clock"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stripedValue is a value placed in a stripe, along with the ticket it was given
+// such that the values of every stripe can be flushed in the order they were put,
+// and when it was placed such that the stripes can linger.
+type stripedValue[T any] struct {
+	v      T
+	ticket uint64
+	at     time.Time
+}
+
+// stripe is one of the buffers of the Striped strategy, each protected by its
+// own mutex
+type stripe[T any] struct {
+	mutex sync.Mutex
+	batch []stripedValue[T]
+	items int
+	bytes int
+	// notified is true once the stripe has woken the writer to flush its share of
+	// a full batch
+	notified bool
+	closed   bool
+	// Avoid false sharing between neighbouring stripes
+	_ [64]byte
+}
+
+// stripeToken is the hint producers use to choose a stripe. Tokens are cached in
+// a sync.Pool, which keeps a private cache for each P, such that a producer
+// usually gets the token last used on the P it is running on.
+type stripeToken struct {
+	stripe int
+}
+
+// stripedQueue implements the Striped strategy. Each producer appends to the
+// stripe chosen by its token, such that producers running on different Ps rarely
+// contend for the same mutex. The writer sweeps every stripe when the interval
+// ticks, or once any stripe holds its share of a full batch, and flushes the
+// values swept in the order they were put.
+type stripedQueue[T any] struct {
+	stripes []*stripe[T]
+	tokens  sync.Pool
+	next    atomic.Uint32
+	// tickets orders the values put into every stripe, as the time two values are
+	// put may be equal
+	tickets atomic.Uint64
+	// shareItems and shareBytes are the share of a full batch each stripe collects
+	// before it wakes the writer
+	shareItems int
+	shareBytes int
+	// swept holds the values swept from every stripe, spares are the recycled
+	// buffers which replace the buffer of each stripe, and batch is reused for
+	// each flush. Only used by the writer.
+	swept    []stripedValue[T]
+	spares   [][]stripedValue[T]
+	batch    []T
+	notifyCh chan struct{}
+	wg       sync.WaitGroup
+	done     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	conf     QueueConfig[T]
+}
+
+func newStripedQueue[T any](conf QueueConfig[T]) *stripedQueue[T] {
+	m := &stripedQueue[T]{
+		stripes:    make([]*stripe[T], conf.Stripes),
+		spares:     make([][]stripedValue[T], conf.Stripes),
+		shareItems: ceilDiv(conf.MinItems, conf.Stripes),
+		shareBytes: ceilDiv(conf.MinBytes, conf.Stripes),
+		swept:      make([]stripedValue[T], 0, conf.Limit),
+		batch:      make([]T, 0, conf.Limit),
+		notifyCh:   make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		conf:       conf,
+	}
+	for i := range m.stripes {
+		m.stripes[i] = &stripe[T]{}
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.tokens.New = func() any {
+		return &stripeToken{stripe: int(m.next.Add(1)-1) % len(m.stripes)}
+	}
+
+	m.wg.Add(1)
+	go m.run()
+
+	return m
+}
+
+// ceilDiv returns n divided by d, rounded up
+func ceilDiv(n, d int) int {
+	return (n + d - 1) / d
+}
+
+// put never blocks, as the stripes are never full
+func (m *stripedQueue[T]) put(_ context.Context, v T, _ bool) error {
+	t := m.tokens.Get().(*stripeToken)
+	s := m.stripes[t.stripe]
+	m.tokens.Put(t)
+
+	items, bytes := m.conf.size(v)
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return ErrClosed
+	}
+	s.batch = append(s.batch, stripedValue[T]{v: v, ticket: m.tickets.Add(1), at: m.conf.queued(v)})
+	s.items += items
+	s.bytes += bytes
+	notify := !s.notified && (s.items >= m.shareItems || (m.shareBytes != 0 && s.bytes >= m.shareBytes))
+	if notify {
+		s.notified = true
+	}
+	s.mutex.Unlock()
+
+	// Wake run() to flush the stripes
+	if notify {
+		select {
+		case m.notifyCh <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// sweep swaps the buffer of every stripe for a recycled buffer and flushes the
+// values swept in the order they were put. Every stripe is locked while swapping,
+// such that a later value from a producer is never swept before an earlier one.
+func (m *stripedQueue[T]) sweep(ctx context.Context, reason Reason) {
+	for _, s := range m.stripes {
+		s.mutex.Lock()
+	}
+	for i, s := range m.stripes {
+		s.batch, m.spares[i] = m.spares[i][:0], s.batch
+		s.items, s.bytes = 0, 0
+		s.notified = false
+	}
+	for _, s := range m.stripes {
+		s.mutex.Unlock()
+	}
+
+	for i, spare := range m.spares {
+		m.swept = append(m.swept, spare...)
+		clear(spare)
+		m.spares[i] = spare[:0]
+	}
+	if len(m.swept) == 0 {
+		return
+	}
+
+	// The values of each stripe are already in order
+	slices.SortFunc(m.swept, func(a, b stripedValue[T]) int {
+		return cmp.Compare(a.ticket, b.ticket)
+	})
+	for _, v := range m.swept {
+		m.batch = append(m.batch, v.v)
+	}
+	clear(m.swept)
+	m.swept = m.swept[:0]
+
+	m.conf.Flush(ctx, m.batch, reason)
+	clear(m.batch)
+	m.batch = m.batch[:0]
+}
+
+// oldest returns when the oldest value in the stripes was put, or false if the
+// stripes are empty
+func (m *stripedQueue[T]) oldest() (time.Time, bool) {
+	var oldest time.Time
+	for _, s := range m.stripes {
+		s.mutex.Lock()
+		if len(s.batch) != 0 && (oldest.IsZero() || s.batch[0].at.Before(oldest)) {
+			oldest = s.batch[0].at
+		}
+		s.mutex.Unlock()
+	}
+	return oldest, !oldest.IsZero()
+}
+
+// len returns the number of values in the stripes
+func (m *stripedQueue[T]) len() int {
+	var n int
+	for _, s := range m.stripes {
+		s.mutex.Lock()
+		n += len(s.batch)
+		s.mutex.Unlock()
+	}
+	return n
+}
+
+func (m *stripedQueue[T]) run() {
+	defer m.wg.Done()
+	if m.conf.lingering() {
+		m.runLinger()
+		return
+	}
+
+	i := m.conf.newInterval()
+	defer i.Stop()
+	i.Next()
+
+	for {
+		select {
+		case <-i.C:
+			m.sweep(m.ctx, ReasonTick)
+			i.Next()
+		case <-m.notifyCh:
+			m.sweep(m.ctx, ReasonSize)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// runLinger sweeps the stripes once any stripe holds its share of a full batch,
+// or MaxLinger has passed since the oldest value in the stripes was put.
+func (m *stripedQueue[T]) runLinger() {
+	timer := clock.NewTimer(m.conf.MaxLinger)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C():
+			wait := m.conf.MaxLinger
+			if oldest, ok := m.oldest(); ok {
+				if wait = m.conf.lingerRemaining(oldest); wait <= 0 {
+					m.sweep(m.ctx, ReasonTick)
+					wait = m.conf.MaxLinger
+				}
+			}
+			timer.Reset(wait)
+		case <-m.notifyCh:
+			m.sweep(m.ctx, ReasonSize)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *stripedQueue[T]) close(ctx context.Context) error {
+	for _, s := range m.stripes {
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			return ErrClosed
+		}
+		s.closed = true
+		s.mutex.Unlock()
+	}
+
+	close(m.done)
+	Wait(ctx, &m.wg, m.cancel)
+
+	m.sweep(ctx, ReasonClose)
+	return ctx.Err()
+}
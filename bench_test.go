@@ -1,15 +1,24 @@
 package queue_test
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"github.com/duh-rpc/duh-go"
 	"github.com/kapetan-io/tackle/clock"
 	"github.com/kapetan-io/tackle/random"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/thrawn01/queue-patterns.go"
 	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"io"
 	"math/rand"
+	"net/http"
 	"runtime"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 )
@@ -24,119 +33,297 @@ func BenchmarkQueuePatterns(b *testing.B) {
 	c := s.MustClient()
 
 	items := generateProduceItems(1_000)
-	mask := len(items) - 1
-
-	b.Run("none", func(b *testing.B) {
-		start := clock.Now()
-		b.ResetTimer()
-
-		b.RunParallel(func(p *testing.PB) {
-			index := int(rand.Uint32() & uint32(mask))
-			for p.Next() {
-				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-				if err := c.ProduceItems(ctx, &pb.ProduceRequest{
-					Items: items[index&mask : index+1&mask],
-				}); err != nil {
-					b.Error(err)
-				}
-				cancel()
-			}
+
+	for _, name := range queue.Patterns() {
+		b.Run(name, func(b *testing.B) {
+			q, err := queue.New(name, queue.BatcherConfig{Client: c, BatchLimit: 1_000})
+			require.NoError(b, err)
+
+			runProducers(b, q, items, 1)
 		})
-		opsPerSec := float64(b.N) / clock.Since(start).Seconds()
-		b.ReportMetric(opsPerSec, "ops/s")
+	}
+}
+
+func BenchmarkPipelineDepth(b *testing.B) {
+	s, err := queue.NewServer(context.Background(), queue.Config{
+		ListenAddress: "localhost:0",
+		RequestSleep:  10 * time.Millisecond,
 	})
+	require.NoError(b, err)
+	defer func() { _ = s.Shutdown(context.Background()) }()
 
-	b.Run("mutex", func(b *testing.B) {
-		m := queue.NewMutex(1_000, c)
+	items := generateProduceItems(1_000)
 
-		start := clock.Now()
-		b.ResetTimer()
+	for _, depth := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("depth-%d", depth), func(b *testing.B) {
+			c, err := queue.NewClient(queue.WithNoTLSConns(s.Listener.Addr().String(), depth))
+			require.NoError(b, err)
+			q, err := queue.NewQueratorPipelined(queue.BatcherConfig{
+				Client:        c,
+				BatchLimit:    1_000,
+				PipelineDepth: depth,
+			})
+			require.NoError(b, err)
 
-		b.RunParallel(func(p *testing.PB) {
-			index := int(rand.Uint32() & uint32(mask))
-			for p.Next() {
-				ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-				if err := m.ProduceItems(ctx, &pb.ProduceRequest{
-					Items: items[index&mask : index+1&mask],
-				}); err != nil {
-					b.Error(err)
-				}
-				cancel()
-			}
+			runProducers(b, q, items, 1)
 		})
-		require.NoError(b, m.Close(context.Background()))
-		opsPerSec := float64(b.N) / clock.Since(start).Seconds()
-		b.ReportMetric(opsPerSec, "ops/s")
+	}
+}
+
+func BenchmarkLinger(b *testing.B) {
+	s, err := queue.NewServer(context.Background(), queue.Config{
+		ListenAddress: "localhost:0",
+		RequestSleep:  10 * time.Millisecond,
 	})
+	require.NoError(b, err)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+	c := s.MustClient()
 
-	b.Run("channel", func(b *testing.B) {
-		ch := queue.NewChannel(1_000, c)
+	items := generateProduceItems(1_000)
 
-		start := clock.Now()
-		b.ResetTimer()
+	for _, name := range queue.Patterns() {
+		if name == "none" {
+			continue
+		}
 
-		b.RunParallel(func(p *testing.PB) {
-			index := int(rand.Uint32() & uint32(mask))
-			for p.Next() {
-				ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-				if err := ch.ProduceItems(ctx, &pb.ProduceRequest{
-					Items: items[index&mask : index+1&mask],
-				}); err != nil {
-					b.Error(err)
-				}
-				cancel()
-			}
-		})
-		require.NoError(b, ch.Close(context.Background()))
-		opsPerSec := float64(b.N) / clock.Since(start).Seconds()
-		b.ReportMetric(opsPerSec, "ops/s")
+		for _, linger := range []time.Duration{0, time.Millisecond, 5 * time.Millisecond,
+			10 * time.Millisecond, 20 * time.Millisecond} {
+
+			b.Run(fmt.Sprintf("%s/linger-%s", name, linger), func(b *testing.B) {
+				q, err := queue.New(name, queue.BatcherConfig{
+					Client:        c,
+					BatchLimit:    1_000,
+					MaxLinger:     linger,
+					MinBatchItems: 100,
+				})
+				require.NoError(b, err)
+
+				runProducers(b, q, items, 1)
+			})
+		}
+	}
+}
+
+// BenchmarkContention compares how the patterns which collect requests behind a
+// mutex or channel hold up as the number of Ps producing at once grows.
+func BenchmarkContention(b *testing.B) {
+	s, err := queue.NewServer(context.Background(), queue.Config{
+		ListenAddress: "localhost:0",
+		RequestSleep:  10 * time.Millisecond,
+	})
+	require.NoError(b, err)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+	c := s.MustClient()
+
+	items := generateProduceItems(1_000)
+
+	for _, procs := range []int{1, 8, 32, 128} {
+		for _, name := range []string{"mutex", "channel", "querator", "striped"} {
+			b.Run(fmt.Sprintf("procs-%d/%s", procs, name), func(b *testing.B) {
+				// Set before the pattern is created, as Striped creates a stripe for each P
+				defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+				q, err := queue.New(name, queue.BatcherConfig{Client: c, BatchLimit: 1_000})
+				require.NoError(b, err)
+
+				runProducers(b, q, items, 1)
+			})
+		}
+	}
+}
+
+// BenchmarkNoAlloc measures the allocations of each request on the request path of
+// QueratorNoAlloc once the pools are warm, against a transport which answers each
+// batch without a server. Each op is a round of requests, one item each, produced
+// at once such that they share a batch, which is sent without allocating once the
+// buffers of the writer have grown to the size of a batch.
+func BenchmarkNoAlloc(b *testing.B) {
+	c, err := queue.NewClient(queue.ClientConfig{
+		Client:   &http.Client{Transport: newStubTransport()},
+		Endpoint: "http://stub",
 	})
+	require.NoError(b, err)
 
-	b.Run("querator", func(b *testing.B) {
-		q := queue.NewQuerator(1_000, c)
+	// Each round of requests is flushed as one batch
+	const producers = 100
+	q, err := queue.NewQueratorNoAlloc(queue.BatcherConfig{
+		Client:        c,
+		MaxLinger:     time.Second,
+		MinBatchItems: producers,
+	})
+	require.NoError(b, err)
+	defer func() { _ = q.Close(context.Background()) }()
 
-		start := clock.Now()
-		b.ResetTimer()
+	ctx := context.Background()
+	items := generateProduceItems(producers)
 
-		b.RunParallel(func(p *testing.PB) {
-			index := int(rand.Uint32() & uint32(mask))
-			for p.Next() {
-				ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-				if err := q.ProduceItems(ctx, &pb.ProduceRequest{
-					Items: items[index&mask : index+1&mask],
-				}); err != nil {
+	// Each producer sends a request for every token received from rounds
+	rounds := make(chan struct{}, producers)
+	var wg sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		go func(req *pb.ProduceRequest) {
+			for range rounds {
+				if err := q.ProduceItems(ctx, req); err != nil {
 					b.Error(err)
 				}
-				cancel()
+				wg.Done()
 			}
-		})
-		require.NoError(b, q.Close(context.Background()))
-		opsPerSec := float64(b.N) / clock.Since(start).Seconds()
-		b.ReportMetric(opsPerSec, "ops/s")
+		}(&pb.ProduceRequest{Items: items[i : i+1]})
+	}
+	defer close(rounds)
+	round := func() {
+		wg.Add(producers)
+		for i := 0; i < producers; i++ {
+			rounds <- struct{}{}
+		}
+		wg.Wait()
+	}
+
+	// Warm up the pools and buffers
+	for i := 0; i < 10; i++ {
+		round()
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		round()
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+
+	assert.Zero(b, (after.Mallocs-before.Mallocs)/uint64(b.N), "allocs/op")
+}
+
+// stubTransport answers every produce request with a successful result for each
+// item, without a server, such that only the client and the pattern allocate. The
+// response is reused, such that only a single round trip may be in flight at once.
+type stubTransport struct {
+	mutex     sync.Mutex
+	buf       []byte
+	items     protowire.Number
+	responses map[int][]byte
+	res       http.Response
+	body      bytes.Reader
+}
+
+func newStubTransport() *stubTransport {
+	t := &stubTransport{
+		items:     (&pb.ProduceRequest{}).ProtoReflect().Descriptor().Fields().ByName("items").Number(),
+		responses: make(map[int][]byte),
+	}
+	t.res = http.Response{
+		StatusCode: duh.CodeOK,
+		Header:     http.Header{"Content-Type": []string{duh.ContentTypeProtoBuf}},
+		Body:       io.NopCloser(&t.body),
+	}
+	return t
+}
+
+func (t *stubTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var err error
+	t.buf = slices.Grow(t.buf[:0], int(r.ContentLength))[:r.ContentLength]
+	_, err = io.ReadFull(r.Body, t.buf)
+	_ = r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Count the items without decoding them
+	var count int
+	for b := t.buf; len(b) != 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		if num == t.items {
+			count++
+		}
+		b = b[n:]
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+
+	body, ok := t.responses[count]
+	if !ok {
+		res := &pb.ProduceResponse{Results: make([]*pb.ProduceItemResult, count)}
+		for i := range res.Results {
+			res.Results[i] = &pb.ProduceItemResult{Code: duh.CodeOK}
+		}
+		if body, err = proto.Marshal(res); err != nil {
+			return nil, err
+		}
+		t.responses[count] = body
+	}
+	t.body.Reset(body)
+	t.res.ContentLength, t.res.Request = int64(len(body)), r
+	return &t.res, nil
+}
+
+// BenchmarkRaw compares the writer marshaling every item in the batch with each
+// caller encoding its own items, such that the writer only appends them.
+func BenchmarkRaw(b *testing.B) {
+	s, err := queue.NewServer(context.Background(), queue.Config{
+		ListenAddress: "localhost:0",
+		RequestSleep:  time.Millisecond,
 	})
+	require.NoError(b, err)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+	c := s.MustClient()
 
-	b.Run("querator-noalloc", func(b *testing.B) {
-		q := queue.NewQueratorNoAlloc(1_000, c)
+	items := generateProduceItems(1_000)
 
-		start := clock.Now()
-		b.ResetTimer()
+	for _, name := range []string{"marshal", "raw"} {
+		b.Run(name, func(b *testing.B) {
+			q, err := queue.NewQuerator(queue.BatcherConfig{Client: c, BatchLimit: 1_000})
+			require.NoError(b, err)
 
-		b.RunParallel(func(p *testing.PB) {
-			index := int(rand.Uint32() & uint32(mask))
-			for p.Next() {
-				ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
-				if err := q.ProduceItems(ctx, &pb.ProduceRequest{
-					Items: items[index&mask : index+1&mask],
-				}); err != nil {
-					b.Error(err)
-				}
-				cancel()
+			var p queue.Producer = q
+			if name == "raw" {
+				p = rawProducer{q}
 			}
+			b.ReportAllocs()
+			runProducers(b, p, items, 10)
 		})
-		require.NoError(b, q.Close(context.Background()))
-		opsPerSec := float64(b.N) / clock.Since(start).Seconds()
-		b.ReportMetric(opsPerSec, "ops/s")
+	}
+}
+
+// runProducers produces requests of perRequest items to q from every goroutine of
+// b.RunParallel, then closes q and reports the requests produced each second.
+func runProducers(b *testing.B, q queue.Producer, items []*pb.ProduceItem, perRequest int) {
+	start := clock.Now()
+	b.ResetTimer()
+
+	b.RunParallel(func(p *testing.PB) {
+		index := rand.Intn(len(items) - perRequest + 1)
+		for p.Next() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			if err := q.ProduceItems(ctx, &pb.ProduceRequest{
+				Items: items[index : index+perRequest],
+			}); err != nil {
+				b.Error(err)
+			}
+			cancel()
+		}
 	})
+	require.NoError(b, q.Close(context.Background()))
+	opsPerSec := float64(b.N) / clock.Since(start).Seconds()
+	b.ReportMetric(opsPerSec, "ops/s")
+}
+
+// rawProducer produces the requests of runProducers with ProduceRaw
+type rawProducer struct {
+	queue.RawProducer
+}
+
+func (p rawProducer) ProduceItems(ctx context.Context, req *pb.ProduceRequest) error {
+	return p.ProduceRaw(ctx, req)
 }
 
 func generateProduceItems(size int) []*pb.ProduceItem {
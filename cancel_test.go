@@ -0,0 +1,62 @@
+package queue_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	"testing"
+	"time"
+)
+
+func TestCancel(t *testing.T) {
+	for _, name := range queue.Patterns() {
+		if name == "none" {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, queue.Config{RequestSleep: 200 * time.Millisecond})
+
+			p, err := queue.New(name, queue.BatcherConfig{
+				Client:        s.Client(t),
+				FlushInterval: time.Millisecond,
+				// Ensure pipelined patterns can only have one batch in flight
+				PipelineDepth: 1,
+			})
+			require.NoError(t, err)
+
+			produce := func(ctx context.Context, item string) chan error {
+				errCh := make(chan error, 1)
+				go func() {
+					errCh <- p.ProduceItems(ctx, produceRequest(item))
+				}()
+				return errCh
+			}
+
+			// The first request is committed to the wire and keeps the writer busy
+			committedCtx, cancelCommitted := context.WithCancel(context.Background())
+			committed := produce(committedCtx, "committed")
+			time.Sleep(50 * time.Millisecond)
+
+			// The second request is queued behind the first and cancelled before it is flushed
+			ctx, cancel := context.WithCancel(context.Background())
+			cancelled := produce(ctx, "cancelled")
+			time.Sleep(20 * time.Millisecond)
+			cancelCommitted()
+			cancel()
+
+			// Cancelling a committed request cannot withdraw it
+			err = <-committed
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.ErrorIs(t, err, queue.ErrCommitted)
+
+			err = <-cancelled
+			assert.ErrorIs(t, err, context.Canceled)
+			assert.NotErrorIs(t, err, queue.ErrCommitted)
+
+			require.NoError(t, p.Close(context.Background()))
+			assert.Equal(t, []string{"committed"}, s.Items())
+		})
+	}
+}
@@ -10,8 +10,23 @@ import (
 	v1 "github.com/duh-rpc/duh-go/proto/v1"
 	"github.com/kapetan-io/tackle/clock"
 	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	resultFields       = (&pb.ProduceItemResult{}).ProtoReflect().Descriptor().Fields()
+	resultsField       = (&pb.ProduceResponse{}).ProtoReflect().Descriptor().Fields().ByName("results").Number()
+	resultCodeField    = resultFields.ByName("code").Number()
+	resultMessageField = resultFields.ByName("message").Number()
+	resultOffsetField  = resultFields.ByName("offset").Number()
 )
 
 type ClientConfig struct {
@@ -19,11 +34,16 @@ type ClientConfig struct {
 	Client *http.Client
 	// The address of endpoint in the format `<scheme>://<host>:<port>`
 	Endpoint string
+	// Retry is the policy used to retry failed requests, and by the patterns which
+	// send through the Client unless BatcherConfig.Retry is set (Default: no retries)
+	Retry RetryPolicy
 }
 
 type Client struct {
-	client *duh.Client
-	conf   ClientConfig
+	// exchanges recycles what each request reuses between round trips
+	exchanges sync.Pool
+	endpoint  string
+	conf      ClientConfig
 }
 
 // NewClient creates a new instance of the Gubernator user client
@@ -36,41 +56,414 @@ func NewClient(conf ClientConfig) (*Client, error) {
 		return nil, errors.New("conf.Endpoint is empty; must provide an http endpoint")
 	}
 
-	return &Client{
-		client: &duh.Client{
-			Client: conf.Client,
-		},
-		conf: conf,
-	}, nil
+	if err := conf.Retry.validate(); err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		endpoint: conf.Endpoint + "/produce",
+		conf:     conf,
+	}
+	c.exchanges.New = func() any { return &exchange{} }
+	return c, nil
+}
+
+// ItemError is returned when the server rejects an item in the request
+type ItemError struct {
+	// Index is the index of the rejected item in the request
+	Index int
+	// Code is the duh code the server returned for the item
+	Code int
+	// Message is the reason the server rejected the item
+	Message string
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("item '%d' rejected with code '%d'; %s", e.Index, e.Code, e.Message)
+}
+
+// checkResults returns an *ItemError for the first item in the results the server rejected
+func checkResults(results []*pb.ProduceItemResult) error {
+	for i, r := range results {
+		if r.Code != duh.CodeOK {
+			return &ItemError{Index: i, Code: int(r.Code), Message: r.Message}
+		}
+	}
+	return nil
 }
 
+// ProduceItems sends the items to the server. If the server rejected any of the
+// items, an *ItemError for the first rejected item is returned.
 func (c *Client) ProduceItems(ctx context.Context, req *pb.ProduceRequest) error {
-	payload, err := proto.Marshal(req)
+	var res pb.ProduceResponse
+	if err := c.ProduceItemsWithResponse(ctx, req, &res); err != nil {
+		return err
+	}
+	return checkResults(res.Results)
+}
+
+// ProduceItemsWithResponse sends the items to the server and fills in res with
+// the result of each item in the same order as the items in the request.
+func (c *Client) ProduceItemsWithResponse(ctx context.Context, req *pb.ProduceRequest, res *pb.ProduceResponse) error {
+	return c.conf.Retry.do(ctx, func(ctx context.Context) error {
+		return c.produce(ctx, req, res)
+	})
+}
+
+// ProduceRaw sends items encoded by EncodeItems to the server without marshaling
+// them again. count is the number of items encoded in raw. If the server rejected
+// any of the items, an *ItemError for the first rejected item is returned.
+func (c *Client) ProduceRaw(ctx context.Context, raw []byte, count int) error {
+	var res pb.ProduceResponse
+	err := c.conf.Retry.do(ctx, func(ctx context.Context) error {
+		return c.produceEncoded(ctx, count, &res, func(buf []byte) ([]byte, error) {
+			return append(buf, raw...), nil
+		})
+	})
 	if err != nil {
+		return err
+	}
+	return checkResults(res.Results)
+}
+
+// produce makes a single attempt at sending the items to the server
+func (c *Client) produce(ctx context.Context, req *pb.ProduceRequest, res *pb.ProduceResponse) error {
+	return c.produceEncoded(ctx, len(req.Items), res, func(buf []byte) ([]byte, error) {
+		return proto.MarshalOptions{}.MarshalAppend(buf, req)
+	})
+}
+
+// produceEncoded makes a single attempt at sending the request encode appends to
+// a recycled buffer. count is the number of items in the encoded request.
+func (c *Client) produceEncoded(ctx context.Context, count int, res *pb.ProduceResponse,
+	encode func(buf []byte) ([]byte, error)) error {
+
+	x := c.exchanges.Get().(*exchange)
+	defer func() {
+		// The results belong to the caller
+		x.results, x.refs = nil, nil
+		c.exchanges.Put(x)
+	}()
+	return c.roundTrip(ctx, x, count, res, encode)
+}
+
+// roundTrip makes a single attempt at sending the request encode appends to the
+// payload of the exchange, and decodes the response into res with the results of
+// the exchange. count is the number of items in the encoded request.
+func (c *Client) roundTrip(ctx context.Context, x *exchange, count int, res *pb.ProduceResponse,
+	encode func(buf []byte) ([]byte, error)) error {
+
+	// A body of the previous round trip may still be open, in which case neither
+	// its payload nor its request may be reused.
+	if x.payload == nil || x.payload.refs.Load() != 0 {
+		x.payload, x.req = &payload{}, nil
+	}
+	p := x.payload
+	p.refs.Store(1)
+	defer p.release()
+
+	var err error
+	if p.buf, err = encode(p.buf[:0]); err != nil {
 		return duh.NewClientError("while marshaling request payload: %w", err, nil)
 	}
 
-	r, err := http.NewRequestWithContext(ctx, http.MethodPost,
-		fmt.Sprintf("%s%s", c.conf.Endpoint, "/produce"), bytes.NewReader(payload))
+	r, err := x.request(ctx, c.endpoint)
 	if err != nil {
 		return duh.NewClientError("", err, nil)
 	}
+	r.Body, r.ContentLength, r.GetBody = http.NoBody, 0, nil
+	if len(p.buf) != 0 {
+		r.Body, r.ContentLength = p.firstBody(), int64(len(p.buf))
+		// Allows the transport to resend the payload on a new connection
+		r.GetBody = p.getBody
+	}
+
+	if err := c.do(x, r, res); err != nil {
+		// The transport does not wrap the ctx error, which callers must be able to match
+		if ctx.Err() != nil && !errors.Is(err, ctx.Err()) {
+			return fmt.Errorf("%w; %w", err, ctx.Err())
+		}
+		return err
+	}
+
+	if len(res.Results) != count {
+		return duh.NewClientError("", fmt.Errorf("server returned '%d' results for '%d' items",
+			len(res.Results), count), nil)
+	}
+	return nil
+}
+
+// do sends the request and fills in res from the response as duh.Client.Do() would,
+// except the response is read into the buffer of the exchange and the results are
+// decoded into the results of the exchange.
+func (c *Client) do(x *exchange, r *http.Request, res *pb.ProduceResponse) error {
+	resp, err := c.send(r)
+	if err != nil {
+		return duh.NewClientError("during client.Do(): %w", err, map[string]string{
+			duh.DetailsHttpUrl:    r.URL.String(),
+			duh.DetailsHttpMethod: r.Method,
+		})
+	}
+	defer func() { _ = resp.Body.Close() }()
 
+	x.buf.Reset()
+	if _, err = x.buf.ReadFrom(resp.Body); err != nil {
+		return duh.NewClientError("while reading response body: %w", err, map[string]string{
+			duh.DetailsHttpUrl:    r.URL.String(),
+			duh.DetailsHttpMethod: r.Method,
+			duh.DetailsHttpStatus: resp.Status,
+		})
+	}
+	body := x.buf.Bytes()
+
+	if !duh.IsDUHCode(resp.StatusCode) {
+		return duh.NewInfraError(r, resp, body)
+	}
+
+	mt := duh.TrimSuffix(resp.Header.Get("Content-Type"), ";,")
+	switch strings.TrimSpace(strings.ToLower(mt)) {
+	case duh.ContentTypeJSON:
+		if resp.StatusCode != duh.CodeOK {
+			return replyError(r, resp, body, protojson.Unmarshal)
+		}
+		err = protojson.Unmarshal(body, res)
+	case duh.ContentTypeProtoBuf:
+		if resp.StatusCode != duh.CodeOK {
+			return replyError(r, resp, body, proto.Unmarshal)
+		}
+		err = x.decode(body, res)
+	default:
+		return duh.NewInfraError(r, resp, body)
+	}
+
+	if err != nil {
+		return duh.NewServiceError(duh.CodeClientError,
+			"", fmt.Errorf("while parsing response body '%s': %w", body, err), nil)
+	}
+	return nil
+}
+
+// replyError returns the error of a response which is not OK, which carries a
+// v1.Reply unless the server is not respecting the spec.
+func replyError(r *http.Request, resp *http.Response, body []byte,
+	unmarshal func([]byte, proto.Message) error) error {
+
+	var reply v1.Reply
+	if err := unmarshal(body, &reply); err != nil {
+		return duh.NewInfraError(r, resp, body)
+	}
+	return duh.NewReplyError(r, resp, &reply)
+}
+
+// send makes the round trip with the transport of the http.Client, unless the
+// http.Client has a Timeout, Jar or CheckRedirect which http.Client.Do() must
+// honor. http.Client.Do() copies the headers and URL of every request, and a
+// redirect is the only other thing it handles, which the server never replies with.
+func (c *Client) send(r *http.Request) (*http.Response, error) {
+	hc := c.conf.Client
+	if hc.Timeout != 0 || hc.Jar != nil || hc.CheckRedirect != nil {
+		return hc.Do(r)
+	}
+
+	t := hc.Transport
+	if t == nil {
+		t = http.DefaultTransport
+	}
+	resp, err := t.RoundTrip(r)
+	if err != nil {
+		return nil, &url.Error{Op: "Post", URL: r.URL.String(), Err: err}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		// Leave following the redirect to http.Client.Do()
+		_ = resp.Body.Close()
+		if r.GetBody != nil {
+			if r.Body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		return hc.Do(r)
+	}
+	return resp, nil
+}
+
+// exchange holds what the Client reuses between round trips, such that a round
+// trip does not allocate once the buffers of the exchange have grown. An exchange
+// is only used by a single round trip at a time.
+type exchange struct {
+	// payload is the buffer each request is marshaled into
+	payload *payload
+	// req is reused by each round trip made with ctx
+	req *http.Request
+	ctx context.Context
+	// buf holds the body of each response
+	buf bytes.Buffer
+	// results back the results decoded into the response, and refs refer to them
+	results []pb.ProduceItemResult
+	refs    []*pb.ProduceItemResult
+}
+
+// request returns a request to the endpoint with ctx. The request of the previous
+// round trip is reused if it was made with the ctx of the exchange.
+func (x *exchange) request(ctx context.Context, endpoint string) (*http.Request, error) {
+	// Only the ctx of the exchange is compared, as a context may not be comparable
+	if x.req != nil && x.ctx != nil && x.ctx == ctx {
+		return x.req, nil
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
 	r.Header.Set("Content-Type", duh.ContentTypeProtoBuf)
-	var res v1.Reply
-	return c.client.Do(r, &res)
+	if x.ctx != nil && x.ctx == ctx {
+		x.req = r
+	}
+	return r, nil
+}
+
+// decode decodes the ProduceResponse in b into res. Unlike proto.Unmarshal(), which
+// allocates every result, the results are decoded into the results of the exchange.
+func (x *exchange) decode(b []byte, res *pb.ProduceResponse) error {
+	var count int
+	err := consumeFields(b, func(num protowire.Number, _ protowire.Type, _ []byte) error {
+		if num == resultsField {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if cap(x.results) < count {
+		x.results = make([]pb.ProduceItemResult, count)
+		x.refs = make([]*pb.ProduceItemResult, count)
+	}
+	res.Results = x.refs[:0]
+
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != resultsField || typ != protowire.BytesType {
+			return nil
+		}
+		v, _ = protowire.ConsumeBytes(v)
+		r := &x.results[len(res.Results)]
+		r.Code, r.Message, r.Offset = 0, "", 0
+		res.Results = append(res.Results, r)
+
+		return consumeFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+			switch {
+			case num == resultCodeField && typ == protowire.VarintType:
+				code, _ := protowire.ConsumeVarint(v)
+				r.Code = int32(code)
+			case num == resultMessageField && typ == protowire.BytesType:
+				msg, _ := protowire.ConsumeBytes(v)
+				r.Message = string(msg)
+			case num == resultOffsetField && typ == protowire.VarintType:
+				offset, _ := protowire.ConsumeVarint(v)
+				r.Offset = int64(offset)
+			}
+			return nil
+		})
+	})
+}
+
+// consumeFields calls fn with the number, type and encoded value of each field in b
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) != 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err := fn(num, typ, b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// payload is a request marshaled into a buffer reused by an exchange. As the
+// transport may close the body of a request after the round trip returns, the
+// payload is only reused once the round trip has returned and every body reading
+// from the buffer has been closed.
+type payload struct {
+	buf  []byte
+	refs atomic.Int32
+	// first is the body of the first attempt at sending the payload, and getBody
+	// is body() created once, such that sending the payload does not allocate
+	first   payloadBody
+	getBody func() (io.ReadCloser, error)
+}
+
+// firstBody returns the body of the first attempt at sending the payload, which
+// releases its reference once closed
+func (p *payload) firstBody() io.ReadCloser {
+	if p.getBody == nil {
+		p.getBody = p.body
+	}
+	p.refs.Add(1)
+	p.first.p = p
+	p.first.Reset(p.buf)
+	p.first.closed.Store(false)
+	return &p.first
+}
+
+// body returns a reader of the payload which releases its reference once closed
+func (p *payload) body() (io.ReadCloser, error) {
+	p.refs.Add(1)
+	b := &payloadBody{p: p}
+	b.Reset(p.buf)
+	return b, nil
+}
+
+// release releases a reference to the payload
+func (p *payload) release() {
+	p.refs.Add(-1)
+}
+
+type payloadBody struct {
+	bytes.Reader
+	p      *payload
+	closed atomic.Bool
+}
+
+func (b *payloadBody) Close() error {
+	if b.closed.CompareAndSwap(false, true) {
+		b.p.release()
+	}
+	return nil
+}
+
+// Close releases any idle connections held by the underlying http.Client
+func (c *Client) Close(_ context.Context) error {
+	c.conf.Client.CloseIdleConnections()
+	return nil
 }
 
 // WithNoTLS returns ClientConfig suitable for use with NON-TLS clients
 func WithNoTLS(address string) ClientConfig {
+	// NOTE: Set to '1' here to simulate single writer in benchmarks
+	return WithNoTLSConns(address, 1)
+}
+
+// WithNoTLSConns returns ClientConfig suitable for use with NON-TLS clients which
+// may have up to `conns` connections to the server open at once. The patterns which
+// send batches in parallel are only effective with a connection for each batch.
+func WithNoTLSConns(address string, conns int) ClientConfig {
 	return ClientConfig{
 		Endpoint: fmt.Sprintf("http://%s", address),
 		Client: &http.Client{
 			Transport: &http.Transport{
-				// NOTE: Set to '1' here to simulate single writer in benchmarks
-				MaxConnsPerHost:     1,
-				MaxIdleConns:        1,
-				MaxIdleConnsPerHost: 1,
+				MaxConnsPerHost:     conns,
+				MaxIdleConns:        conns,
+				MaxIdleConnsPerHost: conns,
 				IdleConnTimeout:     60 * clock.Second,
 			},
 		},
@@ -79,15 +472,21 @@ func WithNoTLS(address string) ClientConfig {
 
 // WithTLS returns ClientConfig suitable for use with TLS clients
 func WithTLS(tls *tls.Config, address string) ClientConfig {
+	// NOTE: Set to '1' here to simulate single writer in benchmarks
+	return WithTLSConns(tls, address, 1)
+}
+
+// WithTLSConns returns ClientConfig suitable for use with TLS clients which
+// may have up to `conns` connections to the server open at once.
+func WithTLSConns(tls *tls.Config, address string, conns int) ClientConfig {
 	return ClientConfig{
 		Endpoint: fmt.Sprintf("https://%s", address),
 		Client: &http.Client{
 			Transport: &http.Transport{
-				TLSClientConfig: tls,
-				// NOTE: Set to '1' here to simulate single writer in benchmarks
-				MaxConnsPerHost:     1,
-				MaxIdleConns:        1,
-				MaxIdleConnsPerHost: 1,
+				TLSClientConfig:     tls,
+				MaxConnsPerHost:     conns,
+				MaxIdleConns:        conns,
+				MaxIdleConnsPerHost: conns,
 				IdleConnTimeout:     60 * clock.Second,
 			},
 		},
@@ -0,0 +1,118 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClose(t *testing.T) {
+	for _, name := range queue.Patterns() {
+		if name == "none" {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, queue.Config{RequestSleep: time.Millisecond})
+
+			p, err := queue.New(name, queue.BatcherConfig{
+				Client: s.Client(t),
+				// Ensure interval based patterns never flush before Close()
+				FlushInterval: time.Minute,
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 10)
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs <- p.ProduceItems(ctx, produceRequest(fmt.Sprintf("item-%d", i)))
+				}(i)
+			}
+
+			// Wait for the producers to queue their requests
+			time.Sleep(100 * time.Millisecond)
+
+			require.NoError(t, p.Close(ctx))
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				assert.NoError(t, err)
+			}
+			assert.Len(t, s.Items(), 10)
+
+			err = p.ProduceItems(ctx, produceRequest("late"))
+			assert.True(t, errors.Is(err, queue.ErrClosed))
+		})
+	}
+}
+
+func TestCloseDeadline(t *testing.T) {
+	for _, name := range queue.Patterns() {
+		if name == "none" {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, queue.Config{RequestSleep: time.Millisecond})
+
+			// Hold every batch the server receives until the test is done
+			release := make(chan struct{})
+			defer close(release)
+			s.SetDelay(func([]string) time.Duration {
+				<-release
+				return 0
+			})
+
+			p, err := queue.New(name, queue.BatcherConfig{
+				Client:      s.Client(t),
+				SendTimeout: time.Minute,
+			})
+			require.NoError(t, err)
+
+			sent, queued := make(chan error, 1), make(chan error, 1)
+			go func() {
+				sent <- p.ProduceItems(context.Background(), produceRequest("sent"))
+			}()
+			time.Sleep(100 * time.Millisecond)
+			go func() {
+				queued <- p.ProduceItems(context.Background(), produceRequest("queued"))
+			}()
+			time.Sleep(100 * time.Millisecond)
+
+			// Close with an expired ctx should give up on the batch in flight and fail
+			// the pending request rather than wait for the server
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			start := time.Now()
+			assert.ErrorIs(t, p.Close(ctx), context.Canceled)
+			assert.Less(t, time.Since(start), time.Second)
+
+			errChs := []chan error{queued}
+			// The batch of a combining caller is sent on the goroutine of the caller,
+			// and so is bound by the ctx of the caller instead.
+			if name != "combiner" {
+				errChs = append(errChs, sent)
+			}
+			for _, errCh := range errChs {
+				select {
+				case err := <-errCh:
+					assert.Error(t, err)
+				case <-time.After(time.Second):
+					t.Fatal("request was not completed by Close")
+				}
+			}
+		})
+	}
+}
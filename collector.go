@@ -0,0 +1,83 @@
+package queue
+
+import (
+	"context"
+	"github.com/thrawn01/queue-patterns.go/batch"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"time"
+)
+
+// collector implements the patterns which are built on the strategies of the batch
+// package. Each request is placed on a batch.Queue which collects the requests and
+// passes each batch to flush(). The patterns which decide the order requests are
+// sent in, or which measure a collect loop of their own, implement their own writer.
+type collector struct {
+	producer
+	queue *batch.Queue[*Request]
+	// sender is reused by every flush, as the batch.Queue never flushes concurrently
+	sender sender
+	conf   BatcherConfig
+}
+
+func (c *collector) init(conf BatcherConfig, s batch.Strategy) error {
+	if err := conf.validate(); err != nil {
+		return err
+	}
+	c.conf = conf
+	c.producer = newProducer(&c.conf, c.put)
+
+	q := conf.queueConfig()
+	q.Flush = c.flush
+	q.Strategy = s
+
+	var err error
+	c.queue, err = batch.NewQueue(q)
+	return err
+}
+
+func (c *collector) flush(ctx context.Context, requests []*Request, reason batch.Reason) {
+	flush(ctx, c.conf, &c.sender, requests, reason)
+}
+
+// ProduceRaw is identical to ProduceItems except the items are encoded on the
+// callers goroutine, such that the writer appends the encoded items to the batch
+// instead of marshaling every item in the batch.
+func (c *collector) ProduceRaw(ctx context.Context, req *pb.ProduceRequest) error {
+	r, err := newRawRequest(ctx, req)
+	if err != nil {
+		return err
+	}
+	if err := c.enqueue(r, true); err != nil {
+		return err
+	}
+	return r.wait()
+}
+
+// Close closes the batch.Queue of the pattern
+func (c *collector) Close(ctx context.Context) error {
+	return c.queue.Close(ctx)
+}
+
+func (c *collector) put(r *Request, block bool) error {
+	var err error
+	c.conf.metrics.queued()
+	if block {
+		err = c.queue.Put(r.Context, r)
+	} else {
+		err = c.queue.TryPut(r)
+	}
+	if err != nil {
+		c.conf.metrics.unqueued()
+	}
+	return err
+}
+
+// requestQueued returns when the request was queued
+func requestQueued(r *Request) time.Time {
+	return r.queued
+}
+
+// requestSize returns the number of items and the encoded size of the request
+func requestSize(r *Request) (items, bytes int) {
+	return len(r.Request.Items), r.size
+}
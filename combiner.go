@@ -0,0 +1,305 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"github.com/kapetan-io/tackle/clock"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"sync"
+)
+
+// Combiner is a flat combining batcher which has no background goroutine or
+// interval. Each caller publishes its request to the queue, and the first caller to
+// arrive while no other caller is combining becomes the combiner. The combiner sends
+// everything published in a single batch, which includes its own request, then
+// passes leadership to a caller waiting on a request which was published while the
+// batch was in flight. If no caller is waiting, the combiner continues to send until
+// the queue is empty, or until it has sent maxCombine batches or its ctx is done,
+// at which point it combines in a short lived goroutine instead.
+//
+// An asynchronous caller does not wait for its request to be sent, so when it must
+// become the combiner it combines in a short lived goroutine which exits once
+// leadership passes on. In linger mode, the combiner waits for the published
+// requests to fill a batch, or the oldest request to wait MaxLinger.
+//
+// As the callers take turns sending the batches, Combiner measures the cost of the
+// handoff between the producers and the writer goroutine in the other patterns.
+type Combiner struct {
+	producer
+	mutex sync.Mutex
+	// queue holds the published requests, and spare is the buffer of the previous
+	// batch which is recycled as the next queue
+	queue []*Request
+	spare []*Request
+	items int
+	bytes int
+	// notifyCh wakes a lingering combiner when a request is published
+	notifyCh chan struct{}
+	// leading is true while a caller is combining or has been appointed to combine
+	leading bool
+	// leader is the request of the caller appointed to combine next
+	leader *Request
+	// idle if set is closed once no caller is combining
+	idle   chan struct{}
+	closed bool
+	sender sender
+	conf   BatcherConfig
+}
+
+func NewCombiner(conf BatcherConfig) (*Combiner, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+
+	m := &Combiner{
+		queue:    make([]*Request, 0, conf.BatchLimit),
+		spare:    make([]*Request, 0, conf.BatchLimit),
+		notifyCh: make(chan struct{}, 1),
+		conf:     conf,
+	}
+	m.producer = newProducer(&m.conf, m.put)
+	return m, nil
+}
+
+// maxCombine is the number of batches a caller sends before it passes leadership
+// on, such that the caller is not held by the requests of other callers
+const maxCombine = 4
+
+// ProduceItems publishes the request and either sends it as the combiner, or waits
+// for another caller to send it. If MaxQueuedBytes is reached, ProduceItems waits
+// for room until ctx is done.
+func (m *Combiner) ProduceItems(ctx context.Context, req *pb.ProduceRequest) error {
+	return m.produce(ctx, req, true)
+}
+
+// TryProduceItems is identical to ProduceItems except it returns ErrQueueFull
+// instead of waiting for room when MaxQueuedBytes is reached.
+func (m *Combiner) TryProduceItems(ctx context.Context, req *pb.ProduceRequest) error {
+	return m.produce(ctx, req, false)
+}
+
+// produce publishes a request whose caller waits for it to be sent, such that
+// the caller may be appointed to combine.
+func (m *Combiner) produce(ctx context.Context, req *pb.ProduceRequest, block bool) error {
+	r := newRequest(ctx, req)
+	r.leadCh = make(chan struct{}, 1)
+	if err := m.enqueue(r, block); err != nil {
+		return err
+	}
+	return m.wait(r)
+}
+
+// put publishes the request. The caller which publishes while no caller is
+// combining becomes the combiner, unless it does not wait for the request to be
+// sent, in which case the combiner runs in a goroutine.
+func (m *Combiner) put(r *Request, _ bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	m.queue = append(m.queue, r)
+	m.items += len(r.Request.Items)
+	m.bytes += r.size
+	m.conf.metrics.queued()
+
+	if m.leading {
+		// Wake the combiner to check if the batch is full
+		if m.conf.lingering() {
+			m.notify()
+		}
+		return nil
+	}
+	m.leading = true
+	if r.leadCh != nil {
+		m.leader = r
+		r.leadCh <- struct{}{}
+		return nil
+	}
+	go m.combine(nil)
+	return nil
+}
+
+// wait combines if the caller is appointed to combine while it waits, else waits
+// for the request to be sent by another caller.
+func (m *Combiner) wait(r *Request) error {
+	select {
+	case <-r.ReadyCh:
+		return r.Err
+	case <-r.leadCh:
+	case <-r.Context.Done():
+		m.mutex.Lock()
+		// Once the caller stops waiting it can no longer be appointed
+		r.leadCh = nil
+		appointed := m.leader == r
+		m.mutex.Unlock()
+		if !appointed {
+			return r.wait()
+		}
+	}
+
+	m.combine(r)
+	select {
+	case <-r.ReadyCh:
+	default:
+		// Leadership was passed on before the request was sent
+		return r.wait()
+	}
+	// As with callers which wait, a caller whose ctx is done once its request
+	// was committed can not know if the request was sent.
+	if r.Err == nil && r.Context.Err() != nil {
+		return fmt.Errorf("%w; %w", ErrCommitted, r.Context.Err())
+	}
+	return r.Err
+}
+
+// combine sends everything published in a batch, until the queue is empty or
+// leadership is passed on. The caller must hold leadership, and r is the request
+// of the caller, or nil if combining in a goroutine. A caller passes leadership on
+// once it has sent maxCombine batches, or its ctx is done.
+func (m *Combiner) combine(r *Request) {
+	var done <-chan struct{}
+	if r != nil {
+		done = r.Context.Done()
+	}
+
+	for n := 0; ; n++ {
+		if m.conf.lingering() {
+			m.linger(done)
+		}
+
+		m.mutex.Lock()
+		m.leader = nil
+		requests := m.queue
+		if len(requests) == 0 {
+			m.leading = false
+			if m.idle != nil {
+				close(m.idle)
+				m.idle = nil
+			}
+			m.mutex.Unlock()
+			return
+		}
+		if r != nil && (n == maxCombine || r.Context.Err() != nil) {
+			// Once the caller stops combining it can no longer be appointed
+			r.leadCh = nil
+			m.handoff()
+			m.mutex.Unlock()
+			return
+		}
+		m.queue, m.spare = m.spare, nil
+		m.items, m.bytes = 0, 0
+		m.mutex.Unlock()
+
+		flush(context.Background(), m.conf, &m.sender, requests,
+			m.conf.reason(requests, m.conf.BatchLimit))
+		clear(requests)
+
+		m.mutex.Lock()
+		m.spare = requests[:0]
+		if next := m.waiter(); next != nil {
+			m.leader = next
+			next.leadCh <- struct{}{}
+			m.mutex.Unlock()
+			return
+		}
+		m.mutex.Unlock()
+	}
+}
+
+// handoff passes leadership to a waiting caller, or to a goroutine if no caller
+// is waiting. The caller must hold the mutex and leadership.
+func (m *Combiner) handoff() {
+	if next := m.waiter(); next != nil {
+		m.leader = next
+		next.leadCh <- struct{}{}
+		return
+	}
+	go m.combine(nil)
+}
+
+// linger waits until the requests published fill a batch, the oldest request has
+// waited MaxLinger, done is closed, or the Combiner is closed. The caller must
+// hold leadership.
+func (m *Combiner) linger(done <-chan struct{}) {
+	for {
+		m.mutex.Lock()
+		if len(m.queue) == 0 || m.closed || m.conf.full(m.items, m.bytes) {
+			m.mutex.Unlock()
+			return
+		}
+		wait := m.conf.lingerRemaining(m.queue[0].queued)
+		m.mutex.Unlock()
+		if wait <= 0 {
+			return
+		}
+
+		timer := clock.NewTimer(wait)
+		select {
+		case <-m.notifyCh:
+		case <-timer.C():
+		case <-done:
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+// notify wakes the combiner if it is lingering
+func (m *Combiner) notify() {
+	select {
+	case m.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+// waiter returns the first published request whose caller is waiting for it to
+// be sent, or nil if there is none. The caller must hold the mutex.
+func (m *Combiner) waiter() *Request {
+	for _, r := range m.queue {
+		if r.leadCh != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+// Close waits for the combining callers to send the requests already published. A
+// batch in flight is sent under the ctx of the caller combining it.
+func (m *Combiner) Close(ctx context.Context) error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	if !m.leading {
+		m.mutex.Unlock()
+		return ctx.Err()
+	}
+	// A lingering combiner sends what remains without waiting
+	m.notify()
+	idle := make(chan struct{})
+	m.idle = idle
+	m.mutex.Unlock()
+
+	select {
+	case <-idle:
+		return ctx.Err()
+	case <-ctx.Done():
+	}
+
+	// Fail the requests no combiner has taken. The combiners will find the queue
+	// empty and stop.
+	m.mutex.Lock()
+	requests := m.queue
+	m.queue = nil
+	m.items, m.bytes = 0, 0
+	m.mutex.Unlock()
+	for _, r := range requests {
+		m.conf.metrics.unqueued()
+		r.complete(ctx.Err())
+	}
+	return ctx.Err()
+}
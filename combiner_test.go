@@ -0,0 +1,150 @@
+package queue_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCombiner(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+	s.SetDelay(func([]string) time.Duration { return 5 * time.Millisecond })
+
+	p, err := queue.NewCombiner(queue.BatcherConfig{Client: s.Client(t)})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const producers, requests = 16, 20
+	var wg sync.WaitGroup
+	for id := 0; id < producers; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				assert.NoError(t, p.ProduceItems(ctx, produceRequest(fmt.Sprintf("%d/%d", id, i))))
+			}
+		}(id)
+	}
+	wg.Wait()
+	require.NoError(t, p.Close(ctx))
+
+	// Only one caller combines at a time, and requests published while a batch
+	// is in flight are combined into the next batch
+	assert.Len(t, s.Items(), producers*requests)
+	assert.Equal(t, 1, s.MaxInFlight())
+	assert.Less(t, s.Requests(), producers*requests)
+}
+
+func TestCombinerCancel(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+	s.SetDelay(func(batch []string) time.Duration {
+		if batch[0] == "a" {
+			return 200 * time.Millisecond
+		}
+		return 0
+	})
+
+	p, err := queue.NewCombiner(queue.BatcherConfig{Client: s.Client(t)})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The first caller combines, and is sending while the others publish
+	done := make(chan error, 1)
+	go func() { done <- p.ProduceItems(ctx, produceRequest("a")) }()
+	require.Eventually(t, func() bool { return s.Requests() == 1 }, time.Second, time.Millisecond)
+
+	// A caller which gives up waiting is never appointed to combine
+	short, shortCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer shortCancel()
+	assert.ErrorIs(t, p.ProduceItems(short, produceRequest("b")), context.DeadlineExceeded)
+
+	// Leadership passes to the caller still waiting
+	require.NoError(t, p.ProduceItems(ctx, produceRequest("c")))
+	require.NoError(t, <-done)
+	require.NoError(t, p.Close(ctx))
+	assert.Equal(t, []string{"a", "c"}, s.Items())
+}
+
+func TestCombinerLoad(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+	s.SetDelay(func([]string) time.Duration { return 5 * time.Millisecond })
+
+	p, err := queue.NewCombiner(queue.BatcherConfig{Client: s.Client(t)})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Asynchronous producers publish faster than the batches are sent, such that
+	// the queue is never empty and no caller waits to be appointed
+	load, stop := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for id := 0; id < 4; id++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for load.Err() == nil {
+				p.ProduceItemsAsync(ctx, produceRequest("load"))
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	// A caller combines a few batches at most, and returns once its ctx is done
+	for i := 0; i < 5; i++ {
+		short, shortCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		start := time.Now()
+		err := p.ProduceItems(short, produceRequest("short"))
+		assert.Less(t, time.Since(start), 200*time.Millisecond)
+		if err != nil {
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		}
+		shortCancel()
+	}
+
+	stop()
+	wg.Wait()
+	require.NoError(t, p.Close(ctx))
+}
+
+func TestCombinerCloseDeadline(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+	s.SetDelay(func(batch []string) time.Duration {
+		if batch[0] == "a" {
+			return 500 * time.Millisecond
+		}
+		return 0
+	})
+
+	p, err := queue.NewCombiner(queue.BatcherConfig{Client: s.Client(t)})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The first caller combines, and is sending while the next request is published
+	done := make(chan error, 1)
+	go func() { done <- p.ProduceItems(ctx, produceRequest("a")) }()
+	require.Eventually(t, func() bool { return s.Requests() == 1 }, time.Second, time.Millisecond)
+	f := p.ProduceItemsAsync(ctx, produceRequest("b"))
+
+	// Close gives up waiting once its ctx is done, and fails the request not yet sent
+	closeCtx, closeCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer closeCancel()
+	start := time.Now()
+	assert.ErrorIs(t, p.Close(closeCtx), context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 300*time.Millisecond)
+	assert.ErrorIs(t, f.Wait(ctx), context.DeadlineExceeded)
+
+	require.NoError(t, <-done)
+	assert.Equal(t, []string{"a"}, s.Items())
+}
@@ -0,0 +1,96 @@
+package queue_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	"testing"
+	"time"
+)
+
+func TestDeadlinePolicy(t *testing.T) {
+	s := newTestServer(t, queue.Config{RequestSleep: 150 * time.Millisecond})
+
+	produce := func(p queue.Producer, timeout time.Duration, item string) chan error {
+		errCh := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			errCh <- p.ProduceItems(ctx, produceRequest(item))
+		}()
+		return errCh
+	}
+
+	t.Run("DeadlineEarliest", func(t *testing.T) {
+		p, err := queue.NewQuerator(queue.BatcherConfig{
+			Client:      s.Client(t),
+			SendTimeout: 50 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		defer func() { _ = p.Close(context.Background()) }()
+
+		// The callers deadline is used instead of the shorter SendTimeout
+		assert.NoError(t, <-produce(p, time.Second, "earliest"))
+	})
+
+	t.Run("DeadlineFixed", func(t *testing.T) {
+		p, err := queue.NewQuerator(queue.BatcherConfig{
+			Client:         s.Client(t),
+			SendTimeout:    50 * time.Millisecond,
+			DeadlinePolicy: queue.DeadlineFixed,
+		})
+		require.NoError(t, err)
+		defer func() { _ = p.Close(context.Background()) }()
+
+		// The SendTimeout is used regardless of the callers deadline
+		assert.Error(t, <-produce(p, time.Second, "fixed"))
+	})
+
+	for _, tc := range []struct {
+		name    string
+		policy  queue.DeadlinePolicy
+		success bool
+	}{
+		{name: "BatchDeadlineEarliest", policy: queue.DeadlineEarliest, success: false},
+		{name: "BatchDeadlineLatest", policy: queue.DeadlineLatest, success: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := queue.NewChannel(queue.BatcherConfig{
+				Client:         s.Client(t),
+				FlushInterval:  time.Minute,
+				DeadlinePolicy: tc.policy,
+			})
+			require.NoError(t, err)
+
+			short := produce(p, 100*time.Millisecond, "short")
+			long := produce(p, time.Second, "long")
+
+			// Close flushes both requests in the same batch
+			time.Sleep(20 * time.Millisecond)
+			require.NoError(t, p.Close(context.Background()))
+
+			assert.Error(t, <-short)
+			if tc.success {
+				assert.NoError(t, <-long)
+				return
+			}
+			assert.Error(t, <-long)
+		})
+	}
+
+	t.Run("RemoveDone", func(t *testing.T) {
+		s := newTestServer(t, queue.Config{RequestSleep: time.Millisecond})
+		p, err := queue.NewChannel(queue.BatcherConfig{
+			Client:        s.Client(t),
+			FlushInterval: 100 * time.Millisecond,
+		})
+		require.NoError(t, err)
+
+		// The request expires before the interval flushes the batch
+		assert.ErrorIs(t, <-produce(p, 10*time.Millisecond, "expired"), context.DeadlineExceeded)
+		require.NoError(t, p.Close(context.Background()))
+		assert.Empty(t, s.Items())
+		assert.Equal(t, 0, s.Requests())
+	})
+}
@@ -0,0 +1,364 @@
+package queue
+
+import (
+	"context"
+	"github.com/kapetan-io/tackle/clock"
+	"github.com/kapetan-io/tackle/set"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thrawn01/queue-patterns.go/batch"
+	"sync"
+	"time"
+)
+
+// tenant holds the queued requests of a single tenant. Fields other than slots
+// are protected by the Fair mutex.
+type tenant struct {
+	// slots bounds the tenant to TenantLimit queued requests, if set
+	slots slots
+	queue []*Request
+	// deficit is the number of items the tenant may still add to a batch this round
+	deficit int
+	active  bool
+	// refs is the number of producers enqueueing a request for the tenant, which
+	// must not be dropped until they are done
+	refs int
+	// idle is when the tenant last had nothing queued
+	idle time.Time
+}
+
+// Fair collects requests like Channel, but queues the requests of each tenant
+// separately and hands out the items of each batch to the tenants using deficit
+// round robin, such that a noisy tenant can not starve the other tenants. Each
+// round, every tenant with queued requests receives TenantQuantum items of credit
+// and sends requests until its credit is spent.
+type Fair struct {
+	producer
+	mutex   sync.Mutex
+	tenants map[string]*tenant
+	// active are the tenants with queued requests in round robin order
+	active []*tenant
+	// cursor is the index in active of the tenant whose turn it is
+	cursor int
+	// inTurn is true if the tenant at cursor has received its quantum this round
+	inTurn bool
+	items  int
+	bytes  int
+	// requests is reused to build each batch, and sent to count the items sent
+	requests []*Request
+	sent     []*Request
+	closed   bool
+	notifyCh chan struct{}
+	sender   sender
+	counts   *prometheus.CounterVec
+	// pruned is when the writer last dropped the idle tenants
+	pruned   time.Time
+	wg       sync.WaitGroup
+	done     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	closeCtx context.Context
+	conf     BatcherConfig
+}
+
+func NewFair(conf BatcherConfig) (*Fair, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	set.Default(&conf.TenantQuantum, max(conf.BatchLimit/10, 1))
+	set.Default(&conf.TenantIdle, DefaultTenantIdle)
+
+	m := &Fair{
+		tenants:  make(map[string]*tenant),
+		requests: make([]*Request, 0, conf.BatchLimit),
+		notifyCh: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		counts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "queue_tenant_items_total",
+			Help:        "The number of items admitted, rejected and sent for each tenant",
+			ConstLabels: conf.constLabels(),
+		}, []string{"tenant", "result"}),
+		conf: conf,
+	}
+	m.producer = newProducer(&m.conf, m.put)
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.rejected = m.reject
+
+	m.wg.Add(1)
+	go m.run()
+
+	return m, nil
+}
+
+func (m *Fair) run() {
+	defer m.wg.Done()
+	if m.conf.lingering() {
+		m.runLinger()
+		return
+	}
+
+	i := m.conf.newInterval()
+	defer i.Stop()
+	i.Next()
+
+	for {
+		select {
+		// Once every tick send everything queued, a batch at a time
+		case <-i.C:
+			m.sendAll(m.ctx, batch.ReasonTick)
+			i.Next()
+		case <-m.done:
+			m.sendAll(m.closeCtx, batch.ReasonClose)
+			return
+		}
+	}
+}
+
+// runLinger sends a batch once the requests queued fill a batch, or the oldest
+// request queued has waited MaxLinger.
+func (m *Fair) runLinger() {
+	for {
+		requests, reason, wait := m.next()
+		if len(requests) != 0 {
+			m.send(m.ctx, requests, reason)
+			continue
+		}
+
+		var timer clock.Timer
+		var lingerC <-chan time.Time
+		if wait > 0 {
+			timer = clock.NewTimer(wait)
+			lingerC = timer.C()
+		}
+
+		select {
+		case <-m.notifyCh:
+		case <-lingerC:
+		case <-m.done:
+			m.sendAll(m.closeCtx, batch.ReasonClose)
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// next returns the requests for the next batch and the reason they were flushed if
+// the requests queued fill a batch or the oldest request has waited MaxLinger. Else
+// returns how long until the oldest request has waited MaxLinger, or zero if nothing
+// is queued.
+func (m *Fair) next() ([]*Request, batch.Reason, time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(m.active) == 0 {
+		return nil, batch.ReasonTick, 0
+	}
+	if m.conf.full(m.items, m.bytes) {
+		return m.take(), batch.ReasonSize, 0
+	}
+
+	oldest := m.active[0].queue[0].queued
+	for _, t := range m.active[1:] {
+		if t.queue[0].queued.Before(oldest) {
+			oldest = t.queue[0].queued
+		}
+	}
+	if wait := m.conf.lingerRemaining(oldest); wait > 0 {
+		return nil, batch.ReasonTick, wait
+	}
+	return m.take(), batch.ReasonTick, 0
+}
+
+// sendAll sends every request queued, a batch at a time
+func (m *Fair) sendAll(ctx context.Context, reason batch.Reason) {
+	for {
+		m.mutex.Lock()
+		requests := m.take()
+		m.mutex.Unlock()
+		if len(requests) == 0 {
+			return
+		}
+		m.send(ctx, requests, reason)
+	}
+}
+
+// send sends the batch, counts the items of each request sent successfully and
+// drops any tenants which have been idle for TenantIdle
+func (m *Fair) send(ctx context.Context, requests []*Request, reason batch.Reason) {
+	// flush() commits the requests in place, so keep a copy to count what was sent
+	m.sent = append(m.sent[:0], requests...)
+	flush(ctx, m.conf, &m.sender, requests, reason)
+
+	for _, r := range m.sent {
+		// Every request is complete once flush() returns
+		if r.Err == nil {
+			m.counts.WithLabelValues(r.Request.Tenant, "sent").Add(float64(len(r.Request.Items)))
+		}
+	}
+	clear(m.sent)
+	m.prune()
+}
+
+// prune drops the tenants which have had nothing queued for TenantIdle along with
+// their metrics. The tenants are checked at most once every TenantIdle.
+func (m *Fair) prune() {
+	if clock.Since(m.pruned) < m.conf.TenantIdle {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pruned = clock.Now()
+	for id, t := range m.tenants {
+		if !t.active && t.refs == 0 && clock.Since(t.idle) >= m.conf.TenantIdle {
+			delete(m.tenants, id)
+			m.counts.DeletePartialMatch(prometheus.Labels{"tenant": id})
+		}
+	}
+}
+
+// take removes the requests for the next batch from the tenants using deficit
+// round robin. The caller must hold the mutex.
+func (m *Fair) take() []*Request {
+	requests := m.requests[:0]
+	var items, bytes int
+
+	for len(m.active) != 0 {
+		t := m.active[m.cursor]
+		if !m.inTurn {
+			t.deficit += m.conf.TenantQuantum
+			m.inTurn = true
+		}
+
+		for len(t.queue) != 0 {
+			r := t.queue[0]
+			size := len(r.Request.Items)
+			if size > t.deficit {
+				break
+			}
+			// The batch is full; the tenant continues its turn in the next batch
+			if len(requests) != 0 && (items+size > m.conf.BatchLimit || bytes+r.size > m.conf.MaxBatchBytes) {
+				return requests
+			}
+			requests = append(requests, r)
+			items += size
+			bytes += r.size
+
+			t.deficit -= size
+			t.queue[0] = nil
+			t.queue = t.queue[1:]
+			t.slots.release()
+			m.items -= size
+			m.bytes -= r.size
+		}
+
+		// End the turn of the tenant, removing it from the round if it has nothing queued
+		m.inTurn = false
+		if len(t.queue) == 0 {
+			t.deficit = 0
+			t.active = false
+			t.idle = clock.Now()
+			m.active = append(m.active[:m.cursor], m.active[m.cursor+1:]...)
+		} else {
+			m.cursor++
+		}
+		if m.cursor >= len(m.active) {
+			m.cursor = 0
+		}
+	}
+	return requests
+}
+
+// put queues the request for its Tenant. If the tenant has TenantLimit requests
+// queued, put waits for room until the ctx of the request is done, unless block
+// is false.
+func (m *Fair) put(r *Request, block bool) error {
+	m.mutex.Lock()
+	t := m.tenant(r.Request.Tenant)
+	t.refs++
+	m.mutex.Unlock()
+
+	err := t.slots.acquire(r.Context, block)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	t.refs--
+	if err != nil {
+		return err
+	}
+	if m.closed {
+		t.slots.release()
+		return ErrClosed
+	}
+	t.queue = append(t.queue, r)
+	if !t.active {
+		t.active = true
+		m.active = append(m.active, t)
+	}
+	m.items += len(r.Request.Items)
+	m.bytes += r.size
+	m.conf.metrics.queued()
+	m.counts.WithLabelValues(r.Request.Tenant, "admitted").Add(float64(len(r.Request.Items)))
+
+	// Wake runLinger() to check if the batch is full
+	select {
+	case m.notifyCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// reject counts the items of a request which could not be queued
+func (m *Fair) reject(r *Request, _ error) {
+	// Counted while holding the mutex, such that prune() can not drop the metrics
+	// of the tenant before they are counted.
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if t := m.tenant(r.Request.Tenant); !t.active {
+		t.idle = clock.Now()
+	}
+	m.counts.WithLabelValues(r.Request.Tenant, "rejected").Add(float64(len(r.Request.Items)))
+}
+
+// tenant returns the tenant with the provided id, adding the tenant if it does
+// not exist. The caller must hold the mutex.
+func (m *Fair) tenant(id string) *tenant {
+	t, ok := m.tenants[id]
+	if !ok {
+		t = &tenant{slots: newSlots(m.conf.TenantLimit), idle: clock.Now()}
+		m.tenants[id] = t
+	}
+	return t
+}
+
+// Close sends what remains in the queue of each tenant
+func (m *Fair) Close(ctx context.Context) error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	m.mutex.Unlock()
+
+	m.closeCtx = ctx
+	close(m.done)
+	batch.Wait(ctx, &m.wg, m.cancel)
+	return ctx.Err()
+}
+
+// Describe fetches prometheus metrics to be registered
+func (m *Fair) Describe(ch chan<- *prometheus.Desc) {
+	m.producer.Describe(ch)
+	m.counts.Describe(ch)
+}
+
+// Collect fetches the queue and tenant metrics for use by prometheus
+func (m *Fair) Collect(ch chan<- prometheus.Metric) {
+	m.producer.Collect(ch)
+	m.counts.Collect(ch)
+}
@@ -0,0 +1,175 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tenantRequest returns a request with an item for each of the provided strings
+// produced by the tenant
+func tenantRequest(tenant string, items ...string) *pb.ProduceRequest {
+	req := produceRequest(items...)
+	req.Tenant = tenant
+	return req
+}
+
+func TestFair(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+
+	p, err := queue.NewFair(queue.BatcherConfig{
+		Client:        s.Client(t),
+		BatchLimit:    10,
+		TenantQuantum: 1,
+		// Nothing is sent until Close()
+		FlushInterval: time.Minute,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The noisy tenant queues all of its requests first
+	var futures []*queue.ProduceFuture
+	for _, tc := range []struct {
+		tenant string
+		count  int
+	}{{"noisy", 20}, {"a", 5}, {"b", 5}} {
+		for i := 0; i < tc.count; i++ {
+			item := fmt.Sprintf("%s-%d", tc.tenant, i)
+			futures = append(futures, p.ProduceItemsAsync(ctx, tenantRequest(tc.tenant, item)))
+		}
+	}
+
+	require.NoError(t, p.Close(ctx))
+	for _, f := range futures {
+		assert.NoError(t, f.Wait(ctx))
+	}
+
+	batches := s.Batches()
+	require.Len(t, batches, 3)
+	// Each tenant receives an equal share of the batch in round robin order
+	assert.Equal(t, []string{
+		"noisy-0", "a-0", "b-0",
+		"noisy-1", "a-1", "b-1",
+		"noisy-2", "a-2", "b-2",
+		"noisy-3",
+	}, batches[0])
+	assert.Equal(t, []string{
+		"a-3", "b-3", "noisy-4",
+		"a-4", "b-4", "noisy-5",
+		"noisy-6", "noisy-7", "noisy-8", "noisy-9",
+	}, batches[1])
+	assert.Len(t, batches[2], 10)
+}
+
+func TestFairTenantLimit(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+
+	p, err := queue.NewFair(queue.BatcherConfig{
+		Client:        s.Client(t),
+		TenantLimit:   2,
+		FlushInterval: time.Minute,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	futures := []*queue.ProduceFuture{
+		p.ProduceItemsAsync(ctx, tenantRequest("noisy", "noisy-0")),
+		p.ProduceItemsAsync(ctx, tenantRequest("noisy", "noisy-1")),
+	}
+
+	// The noisy tenant is full, but other tenants have room
+	err = p.TryProduceItems(ctx, tenantRequest("noisy", "noisy-2", "noisy-3"))
+	assert.True(t, errors.Is(err, queue.ErrQueueFull))
+	futures = append(futures, p.ProduceItemsAsync(ctx, tenantRequest("quiet", "quiet-0")))
+
+	require.NoError(t, p.Close(ctx))
+	for _, f := range futures {
+		assert.NoError(t, f.Wait(ctx))
+	}
+
+	assert.Equal(t, map[string]float64{
+		"noisy/admitted": 2,
+		"noisy/rejected": 2,
+		"noisy/sent":     2,
+		"quiet/admitted": 1,
+		"quiet/sent":     1,
+	}, tenantCounts(t, p))
+}
+
+func TestFairIdleTenants(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+
+	p, err := queue.NewFair(queue.BatcherConfig{
+		Client:        s.Client(t),
+		BatchLimit:    2,
+		MaxBatchBytes: 100,
+		TenantIdle:    100 * time.Millisecond,
+		// Each request is sent as soon as it is queued
+		MaxLinger:     time.Minute,
+		MinBatchItems: 1,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, p.ProduceItems(ctx, tenantRequest("idle", "idle-0")))
+	time.Sleep(150 * time.Millisecond)
+
+	// The idle tenant and its metrics are dropped once the next batch is sent
+	require.NoError(t, p.ProduceItems(ctx, tenantRequest("busy", "busy-0")))
+	assert.Equal(t, map[string]float64{
+		"busy/admitted": 1,
+		"busy/sent":     1,
+	}, tenantCounts(t, p))
+
+	// Every request which is not queued is counted as rejected
+	err = p.ProduceItems(ctx, tenantRequest("busy", strings.Repeat("x", 101)))
+	assert.True(t, errors.Is(err, queue.ErrTooLarge))
+	require.NoError(t, p.Close(ctx))
+	err = p.ProduceItems(ctx, tenantRequest("busy", "busy-4"))
+	assert.True(t, errors.Is(err, queue.ErrClosed))
+
+	assert.Equal(t, map[string]float64{
+		"busy/admitted": 1,
+		"busy/rejected": 2,
+		"busy/sent":     1,
+	}, tenantCounts(t, p))
+}
+
+// tenantCounts returns the count of items for each tenant and result collected
+// from the Fair pattern keyed by "tenant/result"
+func tenantCounts(t *testing.T, p *queue.Fair) map[string]float64 {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(p)
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	counts := make(map[string]float64)
+	for _, f := range families {
+		if f.GetName() != "queue_tenant_items_total" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			counts[labels["tenant"]+"/"+labels["result"]] = m.GetCounter().GetValue()
+		}
+	}
+	return counts
+}
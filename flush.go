@@ -0,0 +1,189 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/thrawn01/queue-patterns.go/batch"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"time"
+)
+
+var (
+	// ErrClosed is returned by ProduceItems when called after Close
+	ErrClosed = batch.ErrClosed
+	// ErrTooLarge is returned by ProduceItems when an item exceeds MaxBatchBytes and
+	// can never be sent in a batch. A request which exceeds the BatchLimit or
+	// MaxBatchBytes is otherwise split across as many batches as it needs.
+	ErrTooLarge = errors.New("request too large")
+	// ErrCommitted is returned by ProduceItems along with the ctx error when ctx was
+	// cancelled after the request was committed to the wire. The items may or may
+	// not have reached the server.
+	ErrCommitted = errors.New("request already committed")
+	// ErrQueueFull is returned by TryProduceItems when there is no room in the queue
+	ErrQueueFull = batch.ErrQueueFull
+)
+
+// flush splits the requests into batches which honor conf.BatchLimit and
+// conf.MaxBatchBytes, then sends each batch in order with s. Each request is
+// committed just before its batch is sent, such that requests withdrawn by the
+// caller or whose context is done are left out of the batch. Each remaining request
+// is completed with the result of the batch which carried its items. The reason is
+// why the requests were flushed, and is recorded for each batch sent.
+func flush(ctx context.Context, conf BatcherConfig, s *sender, requests []*Request,
+	reason batch.Reason) {
+
+	for len(requests) != 0 {
+		n := nextBatch(conf, requests)
+		pending := requests[:n]
+		requests = requests[n:]
+		if conf.order != nil {
+			pending = conf.order.hold(conf, pending)
+		}
+		send(ctx, conf, s, commit(conf, pending), reason)
+	}
+}
+
+// commit commits each request to the wire and returns the committed requests. Any
+// request which could not be committed is completed with the context error. The
+// requests slice is modified in place.
+func commit(conf BatcherConfig, requests []*Request) []*Request {
+	committed := requests[:0]
+	for _, req := range requests {
+		if !req.commit() {
+			conf.metrics.unqueued()
+			conf.metrics.failed("cancelled")
+			req.complete(req.Context.Err())
+			continue
+		}
+		conf.metrics.committed(req)
+		committed = append(committed, req)
+	}
+	return committed
+}
+
+// nextBatch returns the number of requests from the front of the queue which
+// fit into a single batch. Always returns at least one.
+func nextBatch(conf BatcherConfig, requests []*Request) int {
+	var items, size int
+	for i, req := range requests {
+		items += len(req.Request.Items)
+		size += req.size
+		if i != 0 && (items > conf.BatchLimit || size > conf.MaxBatchBytes) {
+			return i
+		}
+	}
+	return len(requests)
+}
+
+// send sends the items from each request to the server in a single batch and
+// completes each request with the results of its own items, such that an item
+// rejected by the server only fails the request which carried it. If ctx is
+// cancelled before the batch is sent, each request is completed with the ctx error.
+func send(ctx context.Context, conf BatcherConfig, s *sender, requests []*Request,
+	reason batch.Reason) {
+
+	if len(requests) == 0 {
+		return
+	}
+	conf.metrics.sent(requests, reason)
+
+	requests, err := produce(ctx, conf, s, requests)
+	completeBatch(conf, requests, &s.res, err)
+}
+
+// produce sends the items from each request to the server in a single batch with
+// s, filling in the response of s with the result of each item, which is valid
+// until s sends the next batch. Returns the requests which remain in the batch, as
+// requests whose context is done are completed and left out between retries.
+func produce(ctx context.Context, conf BatcherConfig, s *sender, requests []*Request) ([]*Request, error) {
+	if err := ctx.Err(); err != nil {
+		return requests, err
+	}
+	if s.attempt == nil {
+		s.attempt, s.encode, s.exchange.ctx = s.sendOnce, s.appendBatch, &s.ctx
+	}
+
+	// Never send or retry beyond the deadline of the batch
+	s.ctx.reset(ctx, batchDeadline(conf, requests))
+	s.conf, s.requests, s.attempts = conf, requests, 0
+	err := conf.Retry.do(&s.ctx, s.attempt)
+	requests, s.requests = s.requests, nil
+	s.ctx.release()
+	return requests, err
+}
+
+// expire completes each request whose context is done with ErrCommitted and the
+// ctx error, as a previous attempt may have delivered its items, and returns the
+// requests which remain. The requests slice is modified in place.
+func expire(conf BatcherConfig, requests []*Request) []*Request {
+	remain := requests[:0]
+	for _, req := range requests {
+		if err := req.Context.Err(); err != nil {
+			conf.metrics.failed("cancelled")
+			req.complete(fmt.Errorf("%w; %w", ErrCommitted, err))
+			continue
+		}
+		remain = append(remain, req)
+	}
+	return remain
+}
+
+// completeBatch completes each request with the results of its own items from res,
+// or with err if the batch failed.
+func completeBatch(conf BatcherConfig, requests []*Request, res *pb.ProduceResponse, err error) {
+	if err != nil {
+		conf.metrics.failed("send")
+		if conf.order != nil {
+			conf.order.fail(requests, err)
+		}
+	}
+
+	var offset int
+	for _, req := range requests {
+		if err != nil {
+			req.complete(err)
+			continue
+		}
+		reqErr := checkResults(res.Results[offset : offset+len(req.Request.Items)])
+		offset += len(req.Request.Items)
+		if reqErr != nil {
+			conf.metrics.failed("rejected")
+		}
+		req.complete(reqErr)
+	}
+}
+
+// batchDeadline returns a deadline derived from the deadlines of the requests
+// according to conf.DeadlinePolicy. If no deadline can be derived, the deadline
+// is conf.SendTimeout from now.
+func batchDeadline(conf BatcherConfig, requests []*Request) time.Time {
+	var deadline time.Time
+	var found bool
+
+	switch conf.DeadlinePolicy {
+	case DeadlineEarliest:
+		for _, req := range requests {
+			if d, ok := req.Context.Deadline(); ok && (!found || d.Before(deadline)) {
+				deadline, found = d, true
+			}
+		}
+	case DeadlineLatest:
+		for _, req := range requests {
+			d, ok := req.Context.Deadline()
+			if !ok {
+				// A request without a deadline has no latest deadline
+				found = false
+				break
+			}
+			if !found || d.After(deadline) {
+				deadline, found = d, true
+			}
+		}
+	}
+
+	if !found {
+		return time.Now().Add(conf.SendTimeout)
+	}
+	return deadline
+}
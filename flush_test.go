@@ -0,0 +1,168 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatchSplitting(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		conf     queue.BatcherConfig
+		item     string
+		maxItems int
+	}{
+		{
+			name:     "BatchLimit",
+			conf:     queue.BatcherConfig{BatchLimit: 5},
+			item:     "item",
+			maxItems: 5,
+		},
+		{
+			// Each item is encoded as 29 bytes, so only 3 items fit in 100 bytes
+			name:     "MaxBatchBytes",
+			conf:     queue.BatcherConfig{BatchLimit: 100, MaxBatchBytes: 100},
+			item:     strings.Repeat("x", 22),
+			maxItems: 3,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, name := range queue.Patterns() {
+				if name == "none" {
+					continue
+				}
+
+				t.Run(name, func(t *testing.T) {
+					s := newTestServer(t, queue.Config{RequestSleep: time.Millisecond})
+					conf := tc.conf
+					conf.Client = s.Client(t)
+					conf.FlushInterval = time.Minute
+
+					p, err := queue.New(name, conf)
+					require.NoError(t, err)
+
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					defer cancel()
+
+					var wg sync.WaitGroup
+					for i := 0; i < 20; i++ {
+						wg.Add(1)
+						go func(i int) {
+							defer wg.Done()
+							item := fmt.Sprintf("%s-%02d", tc.item, i)
+							assert.NoError(t, p.ProduceItems(ctx, produceRequest(item)))
+						}(i)
+					}
+
+					// Wait for the producers to queue their requests
+					time.Sleep(100 * time.Millisecond)
+					require.NoError(t, p.Close(ctx))
+					wg.Wait()
+
+					assert.Len(t, s.Items(), 20)
+					for _, batch := range s.Batches() {
+						assert.LessOrEqual(t, len(batch), tc.maxItems)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	s := newTestServer(t, queue.Config{RequestSleep: time.Millisecond})
+
+	for _, name := range queue.Patterns() {
+		if name == "none" {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			p, err := queue.New(name, queue.BatcherConfig{
+				Client:        s.Client(t),
+				BatchLimit:    5,
+				MaxBatchBytes: 100,
+			})
+			require.NoError(t, err)
+			defer func() { _ = p.Close(context.Background()) }()
+
+			// An item which can never fit into a batch can not be split
+			err = p.ProduceItems(context.Background(), produceRequest(strings.Repeat("x", 101)))
+			assert.ErrorIs(t, err, queue.ErrTooLarge)
+
+			err = p.ProduceItems(context.Background(), produceRequest("1", strings.Repeat("x", 101)))
+			assert.ErrorIs(t, err, queue.ErrTooLarge)
+		})
+	}
+	assert.Empty(t, s.Items())
+}
+
+func TestSplitRequest(t *testing.T) {
+	for _, name := range queue.Patterns() {
+		if name == "none" {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, queue.Config{RequestSleep: time.Millisecond})
+			p, err := queue.New(name, queue.BatcherConfig{
+				Client:        s.Client(t),
+				BatchLimit:    5,
+				MaxBatchBytes: 100,
+			})
+			require.NoError(t, err)
+			defer func() { _ = p.Close(context.Background()) }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var items []string
+			for i := 0; i < 12; i++ {
+				items = append(items, fmt.Sprintf("item-%d", i))
+			}
+			// The pipelined pattern sends the batches of a request in parallel
+			equal := assert.Equal
+			if name == "querator-pipelined" {
+				equal = assert.ElementsMatch
+			}
+
+			// A request with more items than the BatchLimit is sent across batches
+			require.NoError(t, p.ProduceItems(ctx, produceRequest(items...)))
+			equal(t, items, s.Items())
+			for _, batch := range s.Batches() {
+				assert.LessOrEqual(t, len(batch), 5)
+			}
+
+			// A request larger than MaxBatchBytes is sent across batches
+			large := []string{strings.Repeat("a", 40), strings.Repeat("b", 40), strings.Repeat("c", 40)}
+			require.NoError(t, p.ProduceItems(ctx, produceRequest(large...)))
+			equal(t, append(items, large...), s.Items())
+			assert.GreaterOrEqual(t, len(s.Batches()), 5)
+		})
+	}
+}
+
+func TestSplitRequestRejected(t *testing.T) {
+	s := newTestServer(t, queue.Config{RequestSleep: time.Millisecond})
+	p, err := queue.NewQuerator(queue.BatcherConfig{
+		Client:     s.Client(t),
+		BatchLimit: 2,
+	})
+	require.NoError(t, err)
+	defer func() { _ = p.Close(context.Background()) }()
+
+	// The item rejected by the server is reported at its index in the request
+	err = p.ProduceItems(context.Background(), produceRequest("0", "1", "2", "", "4"))
+	var e *queue.ItemError
+	require.True(t, errors.As(err, &e))
+	assert.Equal(t, 3, e.Index)
+	assert.Equal(t, []string{"0", "1", "2", "", "4"}, s.Items())
+}
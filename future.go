@@ -0,0 +1,41 @@
+package queue
+
+import (
+	"context"
+)
+
+// ProduceFuture is the result of a request queued by ProduceItemsAsync()
+type ProduceFuture struct {
+	r *Request
+}
+
+// Done returns a channel which is closed once the request has completed
+func (f *ProduceFuture) Done() <-chan struct{} {
+	return f.r.ReadyCh
+}
+
+// Err returns the result of the request once Done() is closed, or nil if the
+// request has not yet completed.
+func (f *ProduceFuture) Err() error {
+	select {
+	case <-f.r.ReadyCh:
+		return f.r.Err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until the request completes and returns the result. If ctx is done
+// first, Wait returns the ctx error and the request remains queued. If the context
+// passed to ProduceItemsAsync() is done first, the request is withdrawn if it was
+// not yet committed to the wire.
+func (f *ProduceFuture) Wait(ctx context.Context) error {
+	select {
+	case <-f.r.ReadyCh:
+		return f.r.Err
+	case <-f.r.Context.Done():
+		return f.r.wait()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
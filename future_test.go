@@ -0,0 +1,113 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	"testing"
+	"time"
+)
+
+func TestProduceItemsAsync(t *testing.T) {
+	for _, name := range queue.Patterns() {
+		if name == "none" {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, queue.Config{})
+			// Patterns which send immediately hold the requests in flight instead
+			s.SetDelay(func([]string) time.Duration { return 200 * time.Millisecond })
+
+			p, err := queue.New(name, queue.BatcherConfig{
+				Client: s.Client(t),
+				// Ensure interval based patterns never flush before Close()
+				FlushInterval: time.Minute,
+			})
+			require.NoError(t, err)
+			ap, ok := p.(queue.AsyncProducer)
+			require.True(t, ok)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var futures []*queue.ProduceFuture
+			for i := 0; i < 10; i++ {
+				futures = append(futures, ap.ProduceItemsAsync(ctx, produceRequest(fmt.Sprintf("item-%d", i))))
+			}
+
+			// None of the requests have been sent yet
+			f := futures[0]
+			select {
+			case <-f.Done():
+				t.Fatal("future completed before the request was sent")
+			default:
+			}
+			assert.NoError(t, f.Err())
+
+			waitCtx, waitCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+			defer waitCancel()
+			assert.True(t, errors.Is(f.Wait(waitCtx), context.DeadlineExceeded))
+
+			require.NoError(t, p.Close(ctx))
+			for _, f := range futures {
+				assert.NoError(t, f.Wait(ctx))
+				assert.NoError(t, f.Err())
+			}
+			assert.Len(t, s.Items(), 10)
+
+			// Requests which could not be queued complete immediately
+			f = ap.ProduceItemsAsync(ctx, produceRequest("late"))
+			<-f.Done()
+			assert.True(t, errors.Is(f.Err(), queue.ErrClosed))
+		})
+	}
+}
+
+func TestProduceItemsFunc(t *testing.T) {
+	for _, name := range queue.Patterns() {
+		if name == "none" {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, queue.Config{})
+
+			p, err := queue.New(name, queue.BatcherConfig{
+				Client:        s.Client(t),
+				FlushInterval: 10 * time.Millisecond,
+			})
+			require.NoError(t, err)
+			ap, ok := p.(queue.AsyncProducer)
+			require.True(t, ok)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			errs := make(chan error, 10)
+			for i := 0; i < 10; i++ {
+				ap.ProduceItemsFunc(ctx, produceRequest(fmt.Sprintf("item-%d", i)), func(err error) {
+					errs <- err
+				})
+			}
+			for i := 0; i < 10; i++ {
+				select {
+				case err := <-errs:
+					assert.NoError(t, err)
+				case <-ctx.Done():
+					t.Fatal("timed out waiting for callback")
+				}
+			}
+			assert.Len(t, s.Items(), 10)
+
+			require.NoError(t, p.Close(ctx))
+			ap.ProduceItemsFunc(ctx, produceRequest("late"), func(err error) {
+				errs <- err
+			})
+			assert.True(t, errors.Is(<-errs, queue.ErrClosed))
+		})
+	}
+}
@@ -1,17 +1,23 @@
 package queue
 
 import (
+	"errors"
 	"fmt"
 	"github.com/duh-rpc/duh-go"
-	v1 "github.com/duh-rpc/duh-go/proto/v1"
 	"github.com/kapetan-io/tackle/set"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/thrawn01/queue-patterns.go/proto"
 	"net/http"
+	"sync/atomic"
 	"time"
 )
 
+// MaxRequestBytes is the maximum size of a request body the HTTPHandler will accept
+const MaxRequestBytes = duh.MegaByte * 50
+
 type HTTPHandler struct {
+	// offset is the last offset assigned to an accepted item
+	offset   atomic.Int64
 	duration *prometheus.SummaryVec
 	metrics  http.Handler
 	conf     Config
@@ -49,7 +55,7 @@ func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req proto.ProduceRequest
-	if err := duh.ReadRequest(r, &req, duh.MegaByte*50); err != nil {
+	if err := duh.ReadRequest(r, &req, MaxRequestBytes); err != nil {
 		duh.ReplyWithCode(w, r, duh.CodeInternalError, nil, err.Error())
 		return
 	}
@@ -57,7 +63,30 @@ func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Pretend to do some work
 	time.Sleep(h.conf.RequestSleep)
 
-	duh.Reply(w, r, duh.CodeOK, &v1.Reply{Code: duh.CodeOK})
+	res := proto.ProduceResponse{Results: make([]*proto.ProduceItemResult, 0, len(req.Items))}
+	for _, item := range req.Items {
+		if err := validateItem(item); err != nil {
+			res.Results = append(res.Results, &proto.ProduceItemResult{
+				Code:    duh.CodeBadRequest,
+				Message: err.Error(),
+			})
+			continue
+		}
+		res.Results = append(res.Results, &proto.ProduceItemResult{
+			Code:   duh.CodeOK,
+			Offset: h.offset.Add(1),
+		})
+	}
+
+	duh.Reply(w, r, duh.CodeOK, &res)
+}
+
+// validateItem returns an error if the item should be rejected by the server
+func validateItem(item *proto.ProduceItem) error {
+	if len(item.Bytes) == 0 {
+		return errors.New("item bytes cannot be empty")
+	}
+	return nil
 }
 
 // Describe fetches prometheus metrics to be registered
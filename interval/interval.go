@@ -8,12 +8,26 @@ import (
 
 // Interval is a one-shot ticker.  Call `Next()` to trigger the start of the
 // next interval.  Read the `C` channel for tick event.
+//
+// A fixed rate Interval created by NewFixedInterval instead ticks on its own
+// every interval, similar to the fixed tick of TigerBeetle.
+//
+// Interval is built on the timers of the `tackle/clock` package, such that
+// ticks are deterministic once the clock is frozen with clock.Freeze() and
+// advanced with clock.Advance()
 type Interval struct {
 	C     chan struct{}
-	in    chan struct{}
-	done  chan struct{}
-	wg    sync.WaitGroup
 	mutex sync.Mutex
+	timer clock.Timer
+	d     clock.Duration
+	// gen identifies the current timer, such that a timer which fires after it
+	// was replaced or stopped does not tick
+	gen     int
+	fixed   bool
+	armed   bool
+	stopped bool
+	// next is when the next tick of a fixed rate interval is due
+	next time.Time
 }
 
 // NewInterval creates a new ticker like object, however
@@ -21,52 +35,115 @@ type Interval struct {
 // `C` channel will only get a tick after `Next()` has
 // been called.
 func NewInterval(d clock.Duration) *Interval {
-	i := Interval{
-		C:  make(chan struct{}, 1),
-		in: make(chan struct{}, 1),
+	return &Interval{
+		C: make(chan struct{}, 1),
+		d: d,
 	}
-	i.run(d)
-	return &i
 }
 
-func (i *Interval) run(d clock.Duration) {
+// NewFixedInterval creates an Interval which ticks every interval without
+// waiting for `Next()`, keeping the phase of the first tick. If the reader
+// of `C` falls behind, the ticks it missed are dropped and the next tick
+// remains on the original phase. NewFixedInterval panics if d is not greater
+// than zero, as the interval would tick without end.
+func NewFixedInterval(d clock.Duration) *Interval {
+	if d <= 0 {
+		panic("non-positive interval for NewFixedInterval")
+	}
+	i := &Interval{
+		C:     make(chan struct{}, 1),
+		d:     d,
+		fixed: true,
+		next:  clock.Now().Add(d),
+	}
+	i.start(d)
+	return i
+}
+
+// start replaces the current timer with one which ticks after d. The caller
+// must hold the mutex.
+func (i *Interval) start(d clock.Duration) {
+	if i.timer != nil {
+		i.timer.Stop()
+	}
+	i.gen++
+	gen := i.gen
+	i.armed = true
+	i.timer = clock.AfterFunc(d, func() { i.tick(gen) })
+}
+
+func (i *Interval) tick(gen int) {
 	i.mutex.Lock()
-	if i.done == nil {
-		i.done = make(chan struct{})
+	defer i.mutex.Unlock()
+
+	if i.stopped || gen != i.gen {
+		return
+	}
+	// Never block the timer, a tick already waiting in `C` is enough
+	select {
+	case i.C <- struct{}{}:
+	default:
 	}
-	i.mutex.Unlock()
-	i.wg.Add(1)
 
-	go func() {
-		for {
-			select {
-			case <-i.in:
-				time.Sleep(d)
-				i.C <- struct{}{}
-			case <-i.done:
-				i.wg.Done()
-				return
-			}
-		}
-	}()
+	if !i.fixed {
+		i.armed = false
+		return
+	}
+
+	// Keep the phase of the interval, skipping any ticks which were missed
+	now := clock.Now()
+	for !i.next.After(now) {
+		i.next = i.next.Add(i.d)
+	}
+	i.start(i.next.Sub(now))
 }
 
+// Reset changes the duration of the interval. An interval which is waiting
+// to tick restarts the wait with the new duration, and a fixed rate interval
+// takes its phase from the time Reset was called. Reset panics if d is not
+// greater than zero on a fixed rate interval.
+func (i *Interval) Reset(d clock.Duration) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.fixed && d <= 0 {
+		panic("non-positive interval for Interval.Reset")
+	}
+	if i.stopped {
+		return
+	}
+	i.d = d
+	if i.fixed {
+		i.next = clock.Now().Add(d)
+		i.start(d)
+		return
+	}
+	if i.armed {
+		i.start(d)
+	}
+}
+
+// Stop stops the interval. No tick is sent to `C` once Stop returns, and
+// it is safe to call Stop more than once.
 func (i *Interval) Stop() {
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
 
-	if i.done != nil {
-		close(i.done)
+	i.stopped = true
+	if i.timer != nil {
+		i.timer.Stop()
 	}
-	i.wg.Wait()
-	i.done = nil
 }
 
 // Next queues the next interval to run, If multiple calls to Next() are
-// made before previous intervals have completed they are ignored.
+// made before previous intervals have completed they are ignored. Next
+// has no effect on a fixed rate interval.
 func (i *Interval) Next() {
-	select {
-	case i.in <- struct{}{}:
-	default:
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if i.stopped || i.fixed || i.armed {
+		return
 	}
+	i.start(i.d)
 }
@@ -1,6 +1,7 @@
 package interval_test
 
 import (
+	"github.com/kapetan-io/tackle/clock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/thrawn01/queue-patterns.go/interval"
@@ -34,3 +35,90 @@ func TestInterval(t *testing.T) {
 		require.Fail(t, "timeout")
 	}
 }
+
+// ticked returns true if a tick is waiting in the channel
+func ticked(i *interval.Interval) bool {
+	select {
+	case <-i.C:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestIntervalFrozen(t *testing.T) {
+	defer clock.Freeze(clock.Now()).UnFreeze()
+
+	i := interval.NewInterval(10 * clock.Millisecond)
+	defer i.Stop()
+
+	// Nothing ticks until Next() is called
+	clock.Advance(20 * clock.Millisecond)
+	assert.False(t, ticked(i))
+
+	i.Next()
+	clock.Advance(9 * clock.Millisecond)
+	assert.False(t, ticked(i))
+	clock.Advance(clock.Millisecond)
+	assert.True(t, ticked(i))
+
+	// Reset restarts the wait with the new duration
+	i.Next()
+	clock.Advance(5 * clock.Millisecond)
+	i.Reset(20 * clock.Millisecond)
+	clock.Advance(15 * clock.Millisecond)
+	assert.False(t, ticked(i))
+	clock.Advance(5 * clock.Millisecond)
+	assert.True(t, ticked(i))
+
+	// No tick is sent once stopped
+	i.Next()
+	i.Stop()
+	clock.Advance(time.Second)
+	assert.False(t, ticked(i))
+	i.Stop()
+}
+
+func TestFixedInterval(t *testing.T) {
+	defer clock.Freeze(clock.Now()).UnFreeze()
+
+	i := interval.NewFixedInterval(10 * clock.Millisecond)
+	defer i.Stop()
+
+	clock.Advance(10 * clock.Millisecond)
+	assert.True(t, ticked(i))
+
+	// Ticks without waiting for Next()
+	clock.Advance(10 * clock.Millisecond)
+	assert.True(t, ticked(i))
+
+	// Missed ticks are dropped, the next tick keeps the original phase
+	clock.Advance(25 * clock.Millisecond)
+	assert.True(t, ticked(i))
+	assert.False(t, ticked(i))
+	clock.Advance(4 * clock.Millisecond)
+	assert.False(t, ticked(i))
+	clock.Advance(clock.Millisecond)
+	assert.True(t, ticked(i))
+
+	// Reset takes the phase from the time it was called
+	clock.Advance(3 * clock.Millisecond)
+	i.Reset(20 * clock.Millisecond)
+	clock.Advance(19 * clock.Millisecond)
+	assert.False(t, ticked(i))
+	clock.Advance(clock.Millisecond)
+	assert.True(t, ticked(i))
+
+	i.Stop()
+	clock.Advance(time.Second)
+	assert.False(t, ticked(i))
+}
+
+func TestFixedIntervalNonPositive(t *testing.T) {
+	assert.Panics(t, func() { interval.NewFixedInterval(0) })
+	assert.Panics(t, func() { interval.NewFixedInterval(-clock.Millisecond) })
+
+	i := interval.NewFixedInterval(10 * clock.Millisecond)
+	defer i.Stop()
+	assert.Panics(t, func() { i.Reset(0) })
+}
@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"context"
+	"sync"
+)
+
+// limiter bounds the total encoded size of the requests queued in a batcher
+type limiter struct {
+	mutex  sync.Mutex
+	max    int
+	queued int
+	// freed is closed when bytes are released to wake any waiting producers
+	freed chan struct{}
+}
+
+// newLimiter returns a limiter which allows up to max bytes to be queued, or
+// nil if max is zero, in which case the queued bytes are not limited.
+func newLimiter(max int) *limiter {
+	if max == 0 {
+		return nil
+	}
+	return &limiter{max: max}
+}
+
+// acquire reserves room for the request in the queue. If block is false, ErrQueueFull
+// is returned if there is no room, else acquire waits for room until the context of
+// the request is done. A request is always admitted into an empty queue, such that
+// requests larger than the limit are not rejected forever.
+func (l *limiter) acquire(r *Request, block bool) error {
+	if l == nil {
+		return nil
+	}
+
+	for {
+		l.mutex.Lock()
+		if l.queued == 0 || l.queued+r.size <= l.max {
+			l.queued += r.size
+			l.mutex.Unlock()
+			r.limiter = l
+			return nil
+		}
+		if l.freed == nil {
+			l.freed = make(chan struct{})
+		}
+		freed := l.freed
+		l.mutex.Unlock()
+
+		if !block {
+			return ErrQueueFull
+		}
+
+		select {
+		case <-freed:
+		case <-r.Context.Done():
+			return r.Context.Err()
+		}
+	}
+}
+
+// release returns the bytes reserved by acquire and wakes any waiting producers
+func (l *limiter) release(size int) {
+	l.mutex.Lock()
+	l.queued -= size
+	if l.freed != nil {
+		close(l.freed)
+		l.freed = nil
+	}
+	l.mutex.Unlock()
+}
+
+// slots bounds the number of requests in a queue. Each request holds a slot from
+// the time it is queued until the writer takes it from the queue.
+type slots chan struct{}
+
+// newSlots returns slots for up to n requests, or nil if n is zero, in which case
+// the number of requests is not limited.
+func newSlots(n int) slots {
+	if n == 0 {
+		return nil
+	}
+	return make(slots, n)
+}
+
+// acquire reserves a slot. If block is false, ErrQueueFull is returned if every
+// slot is taken, else acquire waits for a free slot until ctx is done.
+func (s slots) acquire(ctx context.Context, block bool) error {
+	if s == nil {
+		return nil
+	}
+	if !block {
+		select {
+		case s <- struct{}{}:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	}
+
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot for any producer waiting for room
+func (s slots) release() {
+	if s != nil {
+		<-s
+	}
+}
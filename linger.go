@@ -0,0 +1,72 @@
+package queue
+
+import (
+	"github.com/kapetan-io/tackle/clock"
+	"github.com/thrawn01/queue-patterns.go/batch"
+	"github.com/thrawn01/queue-patterns.go/interval"
+	"time"
+)
+
+// lingering returns true if linger mode is enabled
+func (c *BatcherConfig) lingering() bool {
+	return c.MaxLinger > 0
+}
+
+// full returns true if the items and bytes collected should be flushed without
+// waiting for the interval or linger to expire.
+func (c *BatcherConfig) full(items, bytes int) bool {
+	return items >= c.MinBatchItems || bytes >= c.MinBatchBytes
+}
+
+// reason returns why requests collected by a writer which flushes as soon as it is
+// able to were flushed
+func (c *BatcherConfig) reason(requests []*Request, limit int) batch.Reason {
+	if len(requests) >= limit || c.full(batchSize(requests)) {
+		return batch.ReasonSize
+	}
+	if c.lingering() {
+		return batch.ReasonTick
+	}
+	return batch.ReasonDrain
+}
+
+// newInterval returns the interval which flushes the requests collected
+func (c *BatcherConfig) newInterval() *interval.Interval {
+	if c.FixedRate {
+		return interval.NewFixedInterval(c.FlushInterval)
+	}
+	return interval.NewInterval(c.FlushInterval)
+}
+
+// lingerRemaining returns how long until a request queued at the provided time has
+// waited MaxLinger
+func (c *BatcherConfig) lingerRemaining(queued time.Time) time.Duration {
+	return c.MaxLinger - clock.Since(queued)
+}
+
+// queueConfig returns the config of a batch.Queue which collects requests the same
+// way as the config, such that patterns which collect requests themselves may use
+// the helpers of the batch package.
+func (c *BatcherConfig) queueConfig() batch.QueueConfig[*Request] {
+	return batch.QueueConfig[*Request]{
+		Limit:         c.BatchLimit,
+		BufferSize:    c.RequestBufferSize,
+		FlushInterval: c.FlushInterval,
+		FixedRate:     c.FixedRate,
+		MaxLinger:     c.MaxLinger,
+		Size:          requestSize,
+		Queued:        requestQueued,
+		MinItems:      c.MinBatchItems,
+		MinBytes:      c.MinBatchBytes,
+		Stripes:       c.Stripes,
+	}
+}
+
+// batchSize returns the total number of items and the encoded size of the requests
+func batchSize(requests []*Request) (items, bytes int) {
+	for _, req := range requests {
+		items += len(req.Request.Items)
+		bytes += req.size
+	}
+	return items, bytes
+}
@@ -0,0 +1,62 @@
+package queue_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLinger(t *testing.T) {
+	for _, name := range queue.Patterns() {
+		if name == "none" {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, queue.Config{RequestSleep: time.Millisecond})
+
+			p, err := queue.New(name, queue.BatcherConfig{
+				Client:        s.Client(t),
+				MaxLinger:     200 * time.Millisecond,
+				MinBatchItems: 5,
+			})
+			require.NoError(t, err)
+			defer func() { _ = p.Close(context.Background()) }()
+
+			t.Run("MinBatchItems", func(t *testing.T) {
+				start := time.Now()
+				var wg sync.WaitGroup
+				for i := 0; i < 5; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						err := p.ProduceItems(context.Background(), produceRequest(fmt.Sprintf("item-%d", i)))
+						assert.NoError(t, err)
+					}(i)
+				}
+				wg.Wait()
+
+				// The batch is flushed as soon as it is full
+				assert.Less(t, time.Since(start), 150*time.Millisecond)
+				require.Len(t, s.Batches(), 1)
+				assert.Len(t, s.Batches()[0], 5)
+			})
+
+			t.Run("MaxLinger", func(t *testing.T) {
+				start := time.Now()
+				require.NoError(t, p.ProduceItems(context.Background(), produceRequest("linger")))
+
+				// The batch is flushed once the request has waited MaxLinger
+				assert.GreaterOrEqual(t, time.Since(start), 190*time.Millisecond)
+				assert.Less(t, time.Since(start), time.Second)
+				require.Len(t, s.Batches(), 2)
+				assert.Equal(t, []string{"linger"}, s.Batches()[1])
+			})
+		})
+	}
+}
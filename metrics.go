@@ -0,0 +1,128 @@
+package queue
+
+import (
+	"github.com/kapetan-io/tackle/clock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thrawn01/queue-patterns.go/batch"
+)
+
+// metrics are the prometheus metrics shared by every queue pattern. A single set
+// of metrics is created by BatcherConfig.validate() for each pattern.
+type metrics struct {
+	batchItems prometheus.Histogram
+	batchBytes prometheus.Histogram
+	wait       prometheus.Histogram
+	depth      prometheus.Gauge
+	flushes    *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	// length if set returns the depth of the queue when collected, instead of
+	// counting each request queued and committed in depth
+	length func() int
+}
+
+func newMetrics(labels prometheus.Labels) *metrics {
+	return &metrics{
+		batchItems: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "queue_batch_items",
+			Help:        "The number of items in each batch sent to the server",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(1, 2, 16),
+		}),
+		batchBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "queue_batch_bytes",
+			Help:        "The encoded size in bytes of the items in each batch sent to the server",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(64, 4, 12),
+		}),
+		wait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "queue_wait_seconds",
+			Help:        "How long requests waited in the queue before they were committed to a batch",
+			ConstLabels: labels,
+			Buckets:     prometheus.ExponentialBuckets(0.0001, 2, 16),
+		}),
+		depth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "queue_depth",
+			Help:        "The number of requests queued which have not been committed to a batch",
+			ConstLabels: labels,
+		}),
+		flushes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "queue_flush_total",
+			Help:        "The number of batches sent to the server by the reason they were flushed",
+			ConstLabels: labels,
+		}, []string{"reason"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "queue_errors_total",
+			Help: "The number of batches which failed to send, and requests which were " +
+				"rejected by the server or withdrawn before they were sent",
+			ConstLabels: labels,
+		}, []string{"error"}),
+	}
+}
+
+// constLabels returns the labels added to every metric of the pattern, such that
+// patterns given different names may register with the same prometheus.Registerer
+func (c *BatcherConfig) constLabels() prometheus.Labels {
+	if c.Name == "" {
+		return nil
+	}
+	return prometheus.Labels{"pattern": c.Name}
+}
+
+// queued records a request was placed in the queue
+func (m *metrics) queued() {
+	if m.length == nil {
+		m.depth.Inc()
+	}
+}
+
+// unqueued records a request counted by queued() left the queue without being
+// committed to a batch
+func (m *metrics) unqueued() {
+	if m.length == nil {
+		m.depth.Dec()
+	}
+}
+
+// committed records the request was committed to a batch
+func (m *metrics) committed(r *Request) {
+	if m.length == nil {
+		m.depth.Dec()
+	}
+	m.wait.Observe(clock.Since(r.queued).Seconds())
+}
+
+// sent records the size of a batch of committed requests sent to the server
+func (m *metrics) sent(requests []*Request, reason batch.Reason) {
+	items, bytes := batchSize(requests)
+	m.batchItems.Observe(float64(items))
+	m.batchBytes.Observe(float64(bytes))
+	m.flushes.WithLabelValues(reason.String()).Inc()
+}
+
+// failed increments the count of errors of the provided kind
+func (m *metrics) failed(kind string) {
+	m.errors.WithLabelValues(kind).Inc()
+}
+
+// Describe fetches prometheus metrics to be registered
+func (m *metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.batchItems.Describe(ch)
+	m.batchBytes.Describe(ch)
+	m.wait.Describe(ch)
+	m.depth.Describe(ch)
+	m.flushes.Describe(ch)
+	m.errors.Describe(ch)
+}
+
+// Collect fetches the queue metrics for use by prometheus
+func (m *metrics) Collect(ch chan<- prometheus.Metric) {
+	m.batchItems.Collect(ch)
+	m.batchBytes.Collect(ch)
+	m.wait.Collect(ch)
+	if m.length != nil {
+		m.depth.Set(float64(m.length()))
+	}
+	m.depth.Collect(ch)
+	m.flushes.Collect(ch)
+	m.errors.Collect(ch)
+}
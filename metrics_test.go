@@ -0,0 +1,184 @@
+package queue_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/duh-rpc/duh-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// gatherMetrics returns the value of each counter, gauge and histogram count
+// collected from the collector keyed by name and labels
+func gatherMetrics(t *testing.T, c prometheus.Collector) map[string]float64 {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			key := f.GetName()
+			for _, l := range m.GetLabel() {
+				key += fmt.Sprintf("{%s=%s}", l.GetName(), l.GetValue())
+			}
+			switch {
+			case m.Counter != nil:
+				values[key] = m.GetCounter().GetValue()
+			case m.Gauge != nil:
+				values[key] = m.GetGauge().GetValue()
+			case m.Histogram != nil:
+				values[key+"_count"] = float64(m.GetHistogram().GetSampleCount())
+				values[key+"_sum"] = m.GetHistogram().GetSampleSum()
+			}
+		}
+	}
+	return values
+}
+
+func TestMetrics(t *testing.T) {
+	s, err := queue.NewServer(context.Background(), queue.Config{
+		ListenAddress: "localhost:0",
+		RequestSleep:  time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+	c := s.MustClient()
+
+	for _, name := range queue.Patterns() {
+		// The client is not a batcher
+		if name == "none" {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			p, err := queue.New(name, queue.BatcherConfig{
+				Client:        c,
+				FlushInterval: time.Minute,
+			})
+			require.NoError(t, err)
+
+			collector, ok := p.(prometheus.Collector)
+			require.True(t, ok, "pattern must implement prometheus.Collector")
+			require.NoError(t, s.Registry.Register(collector))
+			defer s.Registry.Unregister(collector)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			f := p.(queue.AsyncProducer).ProduceItemsAsync(ctx, &pb.ProduceRequest{Items: generateProduceItems(10)})
+			require.NoError(t, p.Close(ctx))
+			require.NoError(t, f.Wait(ctx))
+
+			values := gatherMetrics(t, collector)
+			assert.Equal(t, float64(1), values["queue_batch_items_count"])
+			assert.Equal(t, float64(10), values["queue_batch_items_sum"])
+			assert.Equal(t, float64(1), values["queue_batch_bytes_count"])
+			assert.Equal(t, float64(1), values["queue_wait_seconds_count"])
+			assert.Equal(t, float64(0), values["queue_depth"])
+
+			// Patterns which wait for the interval are flushed by Close, the rest
+			// send the request as soon as they are able to.
+			var flushes float64
+			for _, reason := range []string{"close", "drain"} {
+				flushes += values["queue_flush_total{reason="+reason+"}"]
+			}
+			assert.Equal(t, float64(1), flushes)
+
+			// The batcher metrics are served alongside the server metrics
+			res, err := http.Get(fmt.Sprintf("http://%s/metrics", s.Listener.Addr().String()))
+			require.NoError(t, err)
+			defer func() { _ = res.Body.Close() }()
+			body, err := io.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Contains(t, string(body), "queue_batch_items_count 1")
+			assert.Contains(t, string(body), "http_handler_duration")
+		})
+	}
+}
+
+func TestMetricsErrors(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+
+	p, err := queue.NewMutex(queue.BatcherConfig{
+		Client:        s.Client(t),
+		FlushInterval: time.Minute,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s.FailNext(1, duh.CodeInternalError)
+	f := p.ProduceItemsAsync(ctx, produceRequest("a", "b"))
+
+	// A request withdrawn before it is sent is never committed
+	cancelled, cancelCtx := context.WithCancel(ctx)
+	w := p.ProduceItemsAsync(cancelled, produceRequest("c"))
+	cancelCtx()
+
+	require.NoError(t, p.Close(ctx))
+	assert.Error(t, f.Wait(ctx))
+	assert.ErrorIs(t, w.Wait(ctx), context.Canceled)
+
+	values := gatherMetrics(t, p)
+	assert.Equal(t, float64(1), values["queue_errors_total{error=send}"])
+	assert.Equal(t, float64(1), values["queue_errors_total{error=cancelled}"])
+	assert.Equal(t, float64(1), values["queue_flush_total{reason=close}"])
+	assert.Equal(t, float64(0), values["queue_depth"])
+}
+
+func TestMetricsName(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Patterns given different names register with the same registry at once,
+	// including two instances of the same pattern
+	registry := prometheus.NewRegistry()
+	for _, name := range []string{"mutex", "sharded", "prioritized", "fair"} {
+		for i := 0; i < 2; i++ {
+			p, err := queue.New(name, queue.BatcherConfig{
+				Client:        s.Client(t),
+				FlushInterval: time.Minute,
+				Name:          fmt.Sprintf("%s-%d", name, i),
+			})
+			require.NoError(t, err)
+			require.NoError(t, registry.Register(p.(prometheus.Collector)))
+
+			f := p.(queue.AsyncProducer).ProduceItemsAsync(ctx, produceRequest("a", "b"))
+			require.NoError(t, p.Close(ctx))
+			require.NoError(t, f.Wait(ctx))
+		}
+	}
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	counts := make(map[string]uint64)
+	for _, f := range families {
+		if f.GetName() != "queue_batch_items" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "pattern" {
+					counts[l.GetValue()] = m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string]uint64{
+		"mutex-0": 1, "mutex-1": 1,
+		"sharded-0": 1, "sharded-1": 1,
+		"prioritized-0": 1, "prioritized-1": 1,
+		"fair-0": 1, "fair-1": 1,
+	}, counts)
+}
@@ -0,0 +1,250 @@
+package queue
+
+import (
+	"context"
+	"github.com/kapetan-io/tackle/clock"
+	"github.com/thrawn01/queue-patterns.go/batch"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MPSC pushes each request onto a lock free multi-producer single-consumer linked
+// queue, as described by Dmitry Vyukov. The queue is intrusive, each request links
+// to the next through Request.next, such that a push is a single compare and swap
+// of the head and never allocates. The writer pops everything waiting in the queue
+// and sends it in a batch as soon as it is able to. When the queue is empty the
+// writer parks, and the first producer to push a request once the writer is parked
+// wakes it. Close pushes a sentinel onto the queue, after which no producer can
+// push, such that producers never take a lock.
+//
+// The queue is unbounded; MaxQueuedBytes is the only limit on the requests queued.
+type MPSC struct {
+	producer
+	// head is the request most recently pushed by a producer
+	head atomic.Pointer[Request]
+	// Avoid false sharing between the head and the fields owned by the writer
+	_ [56]byte
+	// tail is the next request to be popped by the writer
+	tail *Request
+	// stub is pushed whenever the writer pops the last request, such that the
+	// queue never becomes empty and producers never contend with the writer
+	stub Request
+	// closer is pushed by Close, and is always the head of a closed queue
+	closer Request
+	// parked is true while the writer is waiting for a producer to push a request
+	parked   atomic.Bool
+	notifyCh chan struct{}
+	// requests is reused to collect each batch
+	requests []*Request
+	sender   sender
+	wg       sync.WaitGroup
+	done     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	closeCtx context.Context
+	conf     BatcherConfig
+}
+
+func NewMPSC(conf BatcherConfig) (*MPSC, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+
+	m := &MPSC{
+		notifyCh: make(chan struct{}, 1),
+		requests: make([]*Request, 0, conf.BatchLimit),
+		done:     make(chan struct{}),
+		conf:     conf,
+	}
+	m.producer = newProducer(&m.conf, m.put)
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.head.Store(&m.stub)
+	m.tail = &m.stub
+
+	m.wg.Add(1)
+	go m.run()
+
+	return m, nil
+}
+
+// push appends the request to the queue. Returns false if the queue is closed.
+// Between the exchange of the head and the link from the previous request, the
+// request is not yet visible to the writer.
+func (m *MPSC) push(r *Request) bool {
+	r.next.Store(nil)
+	for {
+		prev := m.head.Load()
+		if prev == &m.closer {
+			return false
+		}
+		if m.head.CompareAndSwap(prev, r) {
+			prev.next.Store(r)
+			return true
+		}
+	}
+}
+
+// pop removes the request at the front of the queue. Returns nil if the queue is
+// empty, a producer has not yet linked the next request, or every request pushed
+// before the queue was closed has been removed. Only called by the writer.
+func (m *MPSC) pop() *Request {
+	tail := m.tail
+	next := tail.next.Load()
+	if tail == &m.stub {
+		if next == nil {
+			return nil
+		}
+		m.tail = next
+		tail = next
+		next = next.next.Load()
+	}
+	if tail == &m.closer {
+		return nil
+	}
+
+	if next != nil {
+		m.tail = next
+		tail.next.Store(nil)
+		return tail
+	}
+
+	// A producer has swapped the head, but not yet linked its request
+	if tail != m.head.Load() {
+		return nil
+	}
+
+	// tail is the last request, push the stub behind it so it can be removed. If
+	// the queue was closed since, the closer is linked behind it instead.
+	m.push(&m.stub)
+	if next = tail.next.Load(); next != nil {
+		m.tail = next
+		tail.next.Store(nil)
+		return tail
+	}
+	return nil
+}
+
+// collect appends the requests waiting in the queue to the batch, until the batch
+// holds BatchLimit requests
+func (m *MPSC) collect(requests []*Request) []*Request {
+	for len(requests) < m.conf.BatchLimit {
+		r := m.pop()
+		if r == nil {
+			break
+		}
+		requests = append(requests, r)
+	}
+	return requests
+}
+
+// park waits for a producer to push a request. Returns false if timeout fires or
+// the MPSC is closed before a request is pushed.
+func (m *MPSC) park(timeout <-chan time.Time) bool {
+	m.parked.Store(true)
+	// A producer which pushed before the writer parked will not wake the writer. A
+	// producer which has yet to link its request will see the writer is parked.
+	if m.tail.next.Load() != nil {
+		m.parked.Store(false)
+		return true
+	}
+
+	select {
+	case <-m.notifyCh:
+		return true
+	case <-timeout:
+	case <-m.done:
+	}
+	m.parked.Store(false)
+	return false
+}
+
+// wake notifies the writer if it is parked
+func (m *MPSC) wake() {
+	if m.parked.Load() && m.parked.CompareAndSwap(true, false) {
+		select {
+		case m.notifyCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (m *MPSC) run() {
+	defer m.wg.Done()
+
+	for {
+		requests := m.collect(m.requests[:0])
+		if len(requests) != 0 {
+			if m.conf.lingering() {
+				requests = m.linger(requests)
+			}
+			flush(m.ctx, m.conf, &m.sender, requests,
+				m.conf.reason(requests, m.conf.BatchLimit))
+			clear(requests)
+			continue
+		}
+
+		if !m.park(nil) {
+			// Flush what remains in the queue
+			for {
+				requests = m.collect(m.requests[:0])
+				if len(requests) != 0 {
+					flush(m.closeCtx, m.conf, &m.sender, requests, batch.ReasonClose)
+					clear(requests)
+					continue
+				}
+				if m.tail == &m.closer {
+					return
+				}
+				// A producer which pushed before the closer has yet to link its request
+				runtime.Gosched()
+			}
+		}
+	}
+}
+
+// linger collects requests from the queue until the batch is full, the oldest
+// request has waited MaxLinger, the batch holds BatchLimit requests, or the
+// MPSC is closed.
+func (m *MPSC) linger(requests []*Request) []*Request {
+	items, bytes := batchSize(requests)
+	timer := clock.NewTimer(m.conf.lingerRemaining(requests[0].queued))
+	defer timer.Stop()
+
+	for !m.conf.full(items, bytes) && len(requests) < m.conf.BatchLimit {
+		if r := m.pop(); r != nil {
+			requests = append(requests, r)
+			items += len(r.Request.Items)
+			bytes += r.size
+			continue
+		}
+		if !m.park(timer.C()) {
+			return requests
+		}
+	}
+	return requests
+}
+
+// put pushes the request onto the queue, which is never full
+func (m *MPSC) put(r *Request, _ bool) error {
+	m.conf.metrics.queued()
+	if !m.push(r) {
+		m.conf.metrics.unqueued()
+		return ErrClosed
+	}
+	m.wake()
+	return nil
+}
+
+// Close flushes what remains in the queue
+func (m *MPSC) Close(ctx context.Context) error {
+	if !m.push(&m.closer) {
+		return ErrClosed
+	}
+
+	m.closeCtx = ctx
+	close(m.done)
+	batch.Wait(ctx, &m.wg, m.cancel)
+	return ctx.Err()
+}
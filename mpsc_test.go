@@ -0,0 +1,157 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMPSC(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+
+	p, err := queue.NewMPSC(queue.BatcherConfig{
+		Client:     s.Client(t),
+		BatchLimit: 50,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const producers, requests = 16, 100
+	var wg sync.WaitGroup
+	for id := 0; id < producers; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			// Keep many requests from each producer in the queue at once
+			futures := make([]*queue.ProduceFuture, 0, requests)
+			for i := 0; i < requests; i++ {
+				futures = append(futures, p.ProduceItemsAsync(ctx, produceRequest(fmt.Sprintf("%d/%d", id, i))))
+			}
+			for _, f := range futures {
+				assert.NoError(t, f.Wait(ctx))
+			}
+		}(id)
+	}
+	wg.Wait()
+	require.NoError(t, p.Close(ctx))
+
+	// Every item is sent once, in the order each producer pushed it
+	items := s.Items()
+	require.Len(t, items, producers*requests)
+	next := make(map[string]int)
+	for _, item := range items {
+		id, i, ok := strings.Cut(item, "/")
+		require.True(t, ok)
+		n, err := strconv.Atoi(i)
+		require.NoError(t, err)
+		assert.Equal(t, next[id], n, "producer '%s' items out of order", id)
+		next[id] = n + 1
+	}
+}
+
+func TestMPSCWake(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+
+	p, err := queue.NewMPSC(queue.BatcherConfig{Client: s.Client(t)})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 5; i++ {
+		// Give the writer time to park on the empty queue
+		time.Sleep(20 * time.Millisecond)
+
+		// The producer wakes the parked writer which sends the request immediately
+		start := time.Now()
+		require.NoError(t, p.ProduceItems(ctx, produceRequest(fmt.Sprintf("item-%d", i))))
+		assert.Less(t, time.Since(start), 100*time.Millisecond)
+	}
+	require.NoError(t, p.Close(ctx))
+	assert.Len(t, s.Items(), 5)
+}
+
+func TestMPSCCloseRace(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+
+	p, err := queue.NewMPSC(queue.BatcherConfig{Client: s.Client(t)})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Producers push while the queue is closed
+	const producers = 8
+	var wg sync.WaitGroup
+	var sent, closed atomic.Int32
+	for id := 0; id < producers; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				err := p.ProduceItemsAsync(ctx, produceRequest(fmt.Sprintf("%d/%d", id, i))).Wait(ctx)
+				if errors.Is(err, queue.ErrClosed) {
+					closed.Add(1)
+					return
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				sent.Add(1)
+			}
+		}(id)
+	}
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, p.Close(ctx))
+	wg.Wait()
+
+	// Every request pushed before the close is sent, every other request is rejected
+	assert.Equal(t, int32(producers), closed.Load())
+	assert.Len(t, s.Items(), int(sent.Load()))
+}
+
+func TestMPSCDepth(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+	unblock := make(chan struct{})
+	s.SetDelay(func(batch []string) time.Duration {
+		if batch[0] == "first" {
+			<-unblock
+		}
+		return 0
+	})
+
+	p, err := queue.NewMPSC(queue.BatcherConfig{Client: s.Client(t)})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Block the writer in flush, such that the requests pushed next wait in the queue
+	first := p.ProduceItemsAsync(ctx, produceRequest("first"))
+	require.Eventually(t, func() bool { return s.Requests() == 1 }, time.Second, time.Millisecond)
+
+	var futures []*queue.ProduceFuture
+	for i := 0; i < 5; i++ {
+		futures = append(futures, p.ProduceItemsAsync(ctx, produceRequest(fmt.Sprintf("item-%d", i))))
+	}
+	assert.Equal(t, float64(5), gatherMetrics(t, p)["queue_depth"])
+
+	close(unblock)
+	require.NoError(t, first.Wait(ctx))
+	for _, f := range futures {
+		require.NoError(t, f.Wait(ctx))
+	}
+	require.NoError(t, p.Close(ctx))
+	assert.Equal(t, float64(0), gatherMetrics(t, p)["queue_depth"])
+}
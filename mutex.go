@@ -1,95 +1,21 @@
 package queue
 
 import (
-	"context"
-	"github.com/thrawn01/queue-patterns.go/interval"
-	pb "github.com/thrawn01/queue-patterns.go/proto"
-	"sync"
-	"time"
+	"github.com/thrawn01/queue-patterns.go/batch"
 )
 
+// Mutex collects requests into a queue protected by a mutex. When the queue is
+// full, or the interval ticks, the queue is swapped for a recycled buffer while
+// holding the mutex and the swapped batch is sent outside the mutex, such that
+// producers are never blocked by the round trip to the server.
 type Mutex struct {
-	queue      []*Request
-	wg         sync.WaitGroup
-	done       chan struct{}
-	mutex      sync.Mutex
-	client     *Client
-	batchLimit int
+	collector
 }
 
-func NewMutex(limit int, c *Client) *Mutex {
-	m := &Mutex{
-		queue:      make([]*Request, 0, limit),
-		done:       make(chan struct{}),
-		batchLimit: limit,
-		client:     c,
+func NewMutex(conf BatcherConfig) (*Mutex, error) {
+	m := &Mutex{}
+	if err := m.init(conf, batch.Mutex); err != nil {
+		return nil, err
 	}
-
-	m.wg.Add(1)
-	go m.run()
-
-	return m
-}
-
-func (m *Mutex) sendQueue() {
-	var batch pb.ProduceRequest
-	for _, req := range m.queue {
-		batch.Items = append(batch.Items, req.Request.Items...)
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	err := m.client.ProduceItems(ctx, &batch)
-	for _, req := range m.queue {
-		req.Err = err
-		close(req.ReadyCh)
-	}
-	m.queue = make([]*Request, 0, m.batchLimit)
-}
-
-func (m *Mutex) ProduceItems(ctx context.Context, req *pb.ProduceRequest) error {
-	m.mutex.Lock()
-	r := Request{
-		ReadyCh: make(chan struct{}),
-		Request: req,
-		Context: ctx,
-	}
-	m.queue = append(m.queue, &r)
-	if len(m.queue) >= m.batchLimit {
-		m.sendQueue()
-	}
-	m.mutex.Unlock()
-
-	select {
-	case <-r.ReadyCh:
-		return r.Err
-	case <-ctx.Done():
-		return ctx.Err()
-	}
-}
-
-func (m *Mutex) run() {
-	defer m.wg.Done()
-
-	// TODO: Experiment with the interval, use a set tick instead, similar to tiger beetle?
-	i := interval.NewInterval(15 * time.Millisecond)
-	i.Next()
-
-	for {
-		select {
-		case <-i.C:
-			m.mutex.Lock()
-			m.sendQueue()
-			m.mutex.Unlock()
-			i.Next()
-		case <-m.done:
-			return
-		}
-	}
-}
-
-func (m *Mutex) Close(_ context.Context) error {
-	close(m.done)
-	m.wg.Wait()
-	return nil
+	return m, nil
 }
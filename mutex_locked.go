@@ -0,0 +1,139 @@
+package queue
+
+import (
+	"context"
+	"github.com/kapetan-io/tackle/clock"
+	"github.com/thrawn01/queue-patterns.go/batch"
+	"sync"
+)
+
+// MutexLocked sends each batch while holding the mutex, such that every producer
+// is blocked for the duration of the round trip to the server. It is kept so the
+// benchmarks can measure the difference against Mutex.
+type MutexLocked struct {
+	producer
+	mutex  sync.Mutex
+	queue  []*Request
+	items  int
+	bytes  int
+	closed bool
+	wg     sync.WaitGroup
+	done   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	sender sender
+	conf   BatcherConfig
+}
+
+func NewMutexLocked(conf BatcherConfig) (*MutexLocked, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+
+	m := &MutexLocked{
+		queue: make([]*Request, 0, conf.BatchLimit),
+		done:  make(chan struct{}),
+		conf:  conf,
+	}
+	m.producer = newProducer(&m.conf, m.put)
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	m.wg.Add(1)
+	go m.run()
+
+	return m, nil
+}
+
+func (m *MutexLocked) sendQueue(ctx context.Context, reason batch.Reason) {
+	flush(ctx, m.conf, &m.sender, m.queue, reason)
+	m.queue = make([]*Request, 0, m.conf.BatchLimit)
+	m.items, m.bytes = 0, 0
+}
+
+func (m *MutexLocked) put(r *Request, _ bool) error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return ErrClosed
+	}
+	m.queue = append(m.queue, r)
+	m.items += len(r.Request.Items)
+	m.bytes += r.size
+	m.conf.metrics.queued()
+	if m.conf.full(m.items, m.bytes) {
+		m.sendQueue(m.ctx, batch.ReasonSize)
+	}
+	m.mutex.Unlock()
+	return nil
+}
+
+func (m *MutexLocked) run() {
+	defer m.wg.Done()
+	if m.conf.lingering() {
+		m.runLinger()
+		return
+	}
+
+	i := m.conf.newInterval()
+	defer i.Stop()
+	i.Next()
+
+	for {
+		select {
+		case <-i.C:
+			m.mutex.Lock()
+			m.sendQueue(m.ctx, batch.ReasonTick)
+			m.mutex.Unlock()
+			i.Next()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// runLinger flushes the queue once the oldest request in the queue has waited MaxLinger
+func (m *MutexLocked) runLinger() {
+	timer := clock.NewTimer(m.conf.MaxLinger)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C():
+			m.mutex.Lock()
+			wait := m.conf.MaxLinger
+			if len(m.queue) != 0 {
+				if wait = m.conf.lingerRemaining(m.queue[0].queued); wait <= 0 {
+					m.sendQueue(m.ctx, batch.ReasonTick)
+					wait = m.conf.MaxLinger
+				}
+			}
+			m.mutex.Unlock()
+			timer.Reset(wait)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// Close sends what remains in the queue once the writer has stopped
+func (m *MutexLocked) Close(ctx context.Context) error {
+	// Producers send while holding the mutex, so give up on their batch once ctx is done
+	stop := context.AfterFunc(ctx, m.cancel)
+	defer stop()
+
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	m.mutex.Unlock()
+
+	close(m.done)
+	m.wg.Wait()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sendQueue(ctx, batch.ReasonClose)
+	return ctx.Err()
+}
@@ -0,0 +1,337 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kapetan-io/tackle/clock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/thrawn01/queue-patterns.go/batch"
+	"sync"
+	"time"
+)
+
+// LanePolicy is the order the lanes are drained when a batch is built
+type LanePolicy int
+
+const (
+	// LaneStrict fills each batch from the highest priority lane first, such that
+	// a lower priority lane is only sent once every higher priority lane is empty.
+	LaneStrict LanePolicy = iota
+	// LaneWeighted gives each lane a share of each batch in proportion to its
+	// Weight, then fills what remains of the batch in priority order.
+	LaneWeighted
+)
+
+type LaneConfig struct {
+	// Name is the value of the `lane` label of the lane metrics (Default: the index of the lane)
+	Name string
+	// Capacity is the number of requests the lane holds before producers must wait
+	// for room. (Default: RequestBufferSize)
+	Capacity int
+	// MaxLinger is how long the oldest request in the lane waits for the batch to
+	// fill. Zero sends as soon as possible. (Default: MaxLinger)
+	MaxLinger clock.Duration
+	// Weight is the share of each batch given to the lane by LaneWeighted (Default: 1)
+	Weight int
+}
+
+// lane holds the requests of a single priority. Fields other than slots are
+// protected by the Prioritized mutex.
+type lane struct {
+	// slots bounds the lane to Capacity requests
+	slots slots
+	queue []*Request
+	items int
+	bytes int
+	conf  LaneConfig
+}
+
+// Prioritized queues each request in the lane of its Priority and builds each batch
+// from the lanes according to the LanePolicy, such that a burst of low priority
+// requests does not delay high priority requests. A batch is built once any lane
+// is ready; a lane is ready once it is full, or its oldest request has waited the
+// MaxLinger of the lane.
+type Prioritized struct {
+	producer
+	mutex sync.Mutex
+	lanes []*lane
+	// requests is reused to build each batch
+	requests    []*Request
+	totalWeight int
+	closed      bool
+	notifyCh    chan struct{}
+	sender      sender
+	depth       *prometheus.GaugeVec
+	wait        *prometheus.HistogramVec
+	wg          sync.WaitGroup
+	done        chan struct{}
+	ctx         context.Context
+	cancel      context.CancelFunc
+	closeCtx    context.Context
+	conf        BatcherConfig
+}
+
+func NewPrioritized(conf BatcherConfig) (*Prioritized, error) {
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	if conf.LanePolicy != LaneStrict && conf.LanePolicy != LaneWeighted {
+		return nil, errors.New("conf.LanePolicy is invalid")
+	}
+	if len(conf.Lanes) == 0 {
+		conf.Lanes = []LaneConfig{{}}
+	}
+
+	m := &Prioritized{
+		requests: make([]*Request, 0, conf.BatchLimit),
+		notifyCh: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		depth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "queue_lane_depth",
+			Help:        "The number of requests waiting in each priority lane",
+			ConstLabels: conf.constLabels(),
+		}, []string{"lane"}),
+		wait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "queue_lane_wait_seconds",
+			Help:        "How long requests waited in each priority lane before they were added to a batch",
+			ConstLabels: conf.constLabels(),
+			Buckets:     prometheus.ExponentialBuckets(0.0001, 2, 16),
+		}, []string{"lane"}),
+		conf: conf,
+	}
+	m.producer = newProducer(&m.conf, m.put)
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+
+	for i, c := range conf.Lanes {
+		if c.Capacity < 0 || c.MaxLinger < 0 || c.Weight < 0 {
+			return nil, fmt.Errorf("conf.Lanes[%d] is invalid; Capacity, MaxLinger and Weight "+
+				"must be greater than zero", i)
+		}
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("%d", i)
+		}
+		if c.Capacity == 0 {
+			c.Capacity = conf.RequestBufferSize
+		}
+		if c.MaxLinger == 0 {
+			c.MaxLinger = conf.MaxLinger
+		}
+		if c.Weight == 0 {
+			c.Weight = 1
+		}
+		m.lanes = append(m.lanes, &lane{slots: make(slots, c.Capacity), conf: c})
+		m.totalWeight += c.Weight
+	}
+
+	m.wg.Add(1)
+	go m.run()
+
+	return m, nil
+}
+
+// lane returns the lane for the priority. Priorities beyond the last lane are
+// queued in the last lane.
+func (m *Prioritized) lane(priority int32) *lane {
+	switch {
+	case priority < 0:
+		return m.lanes[0]
+	case int(priority) >= len(m.lanes):
+		return m.lanes[len(m.lanes)-1]
+	}
+	return m.lanes[priority]
+}
+
+func (m *Prioritized) run() {
+	defer m.wg.Done()
+
+	for {
+		requests, reason, wait := m.next(false)
+		if len(requests) != 0 {
+			flush(m.ctx, m.conf, &m.sender, requests, reason)
+			continue
+		}
+
+		// Wake once the oldest lingering request has waited the MaxLinger of its lane
+		var timer clock.Timer
+		var lingerC <-chan time.Time
+		if wait > 0 {
+			timer = clock.NewTimer(wait)
+			lingerC = timer.C()
+		}
+
+		select {
+		case <-m.notifyCh:
+		case <-lingerC:
+		case <-m.done:
+			// Send what remains in priority order
+			for {
+				requests, _, _ = m.next(true)
+				if len(requests) == 0 {
+					break
+				}
+				flush(m.closeCtx, m.conf, &m.sender, requests, batch.ReasonClose)
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// next returns the requests for the next batch and the reason the first ready lane
+// was flushed if any lane is ready, or force is true. Else returns how long until
+// the next lingering lane is ready, or zero if every lane is empty.
+func (m *Prioritized) next(force bool) ([]*Request, batch.Reason, time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ready, reason := force, batch.ReasonClose
+	var wait time.Duration
+	for _, l := range m.lanes {
+		if len(l.queue) == 0 {
+			continue
+		}
+		remaining := l.conf.MaxLinger - clock.Since(l.queue[0].queued)
+		if m.conf.full(l.items, l.bytes) {
+			ready, reason = true, batch.ReasonSize
+			break
+		}
+		if remaining <= 0 {
+			// A lane which does not linger is sent as soon as possible
+			ready, reason = true, batch.ReasonTick
+			if l.conf.MaxLinger == 0 {
+				reason = batch.ReasonDrain
+			}
+			break
+		}
+		if wait == 0 || remaining < wait {
+			wait = remaining
+		}
+	}
+	if !ready {
+		return nil, reason, wait
+	}
+	return m.take(), reason, 0
+}
+
+// take removes the requests for the next batch from the lanes according to the
+// LanePolicy. The caller must hold the mutex.
+func (m *Prioritized) take() []*Request {
+	requests := m.requests[:0]
+	var items, bytes int
+	var full bool
+
+	if m.conf.LanePolicy == LaneWeighted {
+		for _, l := range m.lanes {
+			quota := max(m.conf.BatchLimit*l.conf.Weight/m.totalWeight, 1)
+			if requests, items, bytes, full = m.takeLane(l, requests, items, bytes, quota); full {
+				return requests
+			}
+		}
+	}
+
+	// Fill what remains of the batch in priority order
+	for _, l := range m.lanes {
+		if requests, items, bytes, full = m.takeLane(l, requests, items, bytes, m.conf.BatchLimit); full {
+			return requests
+		}
+	}
+	return requests
+}
+
+// takeLane appends requests from the front of the lane to the batch until the lane
+// is empty, quota items have been taken from the lane, or the batch is full.
+// The caller must hold the mutex.
+func (m *Prioritized) takeLane(l *lane, requests []*Request, items, bytes, quota int) ([]*Request, int, int, bool) {
+	var n, taken int
+	var full bool
+	for _, r := range l.queue {
+		size := len(r.Request.Items)
+		if taken+size > quota && taken != 0 {
+			break
+		}
+		if len(requests) != 0 && (items+size > m.conf.BatchLimit || bytes+r.size > m.conf.MaxBatchBytes) {
+			full = true
+			break
+		}
+		requests = append(requests, r)
+		items += size
+		bytes += r.size
+		taken += size
+		n++
+
+		l.items -= size
+		l.bytes -= r.size
+		m.wait.WithLabelValues(l.conf.Name).Observe(clock.Since(r.queued).Seconds())
+		l.slots.release()
+	}
+
+	clear(l.queue[:n])
+	l.queue = l.queue[n:]
+	m.depth.WithLabelValues(l.conf.Name).Set(float64(len(l.queue)))
+	return requests, items, bytes, full
+}
+
+// put queues the request in the lane of its Priority. If the lane is full, put
+// waits for room until the ctx of the request is done, unless block is false.
+func (m *Prioritized) put(r *Request, block bool) error {
+	l := m.lane(r.Request.Priority)
+	if err := l.slots.acquire(r.Context, block); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		l.slots.release()
+		return ErrClosed
+	}
+	l.queue = append(l.queue, r)
+	l.items += len(r.Request.Items)
+	l.bytes += r.size
+	m.depth.WithLabelValues(l.conf.Name).Set(float64(len(l.queue)))
+	m.conf.metrics.queued()
+	m.mutex.Unlock()
+
+	// Wake run() to build the next batch
+	select {
+	case m.notifyCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Close sends what remains in the lanes in priority order
+func (m *Prioritized) Close(ctx context.Context) error {
+	m.mutex.Lock()
+	if m.closed {
+		m.mutex.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	m.mutex.Unlock()
+
+	m.closeCtx = ctx
+	close(m.done)
+	batch.Wait(ctx, &m.wg, m.cancel)
+	return ctx.Err()
+}
+
+// Describe fetches prometheus metrics to be registered
+func (m *Prioritized) Describe(ch chan<- *prometheus.Desc) {
+	m.producer.Describe(ch)
+	m.depth.Describe(ch)
+	m.wait.Describe(ch)
+}
+
+// Collect fetches the queue and lane metrics for use by prometheus
+func (m *Prioritized) Collect(ch chan<- prometheus.Metric) {
+	m.producer.Collect(ch)
+	m.depth.Collect(ch)
+	m.wait.Collect(ch)
+}
@@ -0,0 +1,166 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"testing"
+	"time"
+)
+
+// priorityRequest returns a request with an item for each of the provided strings
+// in the lane of the priority
+func priorityRequest(priority int32, items ...string) *pb.ProduceRequest {
+	req := produceRequest(items...)
+	req.Priority = priority
+	return req
+}
+
+func TestPrioritized(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policy   queue.LanePolicy
+		expected [][]string
+	}{
+		{
+			name:   "LaneStrict",
+			policy: queue.LaneStrict,
+			expected: [][]string{
+				{"high-0", "high-1", "high-2", "low-0"},
+				{"low-1", "low-2"},
+			},
+		},
+		{
+			name:   "LaneWeighted",
+			policy: queue.LaneWeighted,
+			expected: [][]string{
+				{"high-0", "high-1", "low-0", "low-1"},
+				{"high-2", "low-2"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, queue.Config{})
+
+			p, err := queue.NewPrioritized(queue.BatcherConfig{
+				Client:     s.Client(t),
+				BatchLimit: 4,
+				LanePolicy: tc.policy,
+				// Neither lane is sent until Close()
+				Lanes: []queue.LaneConfig{
+					{Name: "high", MaxLinger: time.Minute},
+					{Name: "low", MaxLinger: time.Minute},
+				},
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var futures []*queue.ProduceFuture
+			for _, item := range []string{"low-0", "low-1", "low-2"} {
+				futures = append(futures, p.ProduceItemsAsync(ctx, priorityRequest(1, item)))
+			}
+			for _, item := range []string{"high-0", "high-1", "high-2"} {
+				futures = append(futures, p.ProduceItemsAsync(ctx, priorityRequest(0, item)))
+			}
+
+			require.NoError(t, p.Close(ctx))
+			for _, f := range futures {
+				assert.NoError(t, f.Wait(ctx))
+			}
+			assert.Equal(t, tc.expected, s.Batches())
+		})
+	}
+}
+
+func TestPrioritizedLaneLinger(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+
+	p, err := queue.NewPrioritized(queue.BatcherConfig{
+		Client: s.Client(t),
+		Lanes: []queue.LaneConfig{
+			{Name: "high"},
+			{Name: "low", MaxLinger: time.Minute},
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The low priority lane lingers
+	low := p.ProduceItemsAsync(ctx, priorityRequest(1, "low"))
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-low.Done():
+		t.Fatal("low priority request was sent before it lingered")
+	default:
+	}
+
+	// The high priority lane is sent immediately, taking the lingering request with it
+	require.NoError(t, p.ProduceItems(ctx, priorityRequest(0, "high")))
+	assert.NoError(t, low.Wait(ctx))
+	assert.Equal(t, [][]string{{"high", "low"}}, s.Batches())
+	require.NoError(t, p.Close(ctx))
+}
+
+func TestPrioritizedLaneCapacity(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+
+	p, err := queue.NewPrioritized(queue.BatcherConfig{
+		Client: s.Client(t),
+		Lanes: []queue.LaneConfig{
+			{Name: "high", MaxLinger: time.Minute},
+			{Name: "low", MaxLinger: time.Minute, Capacity: 1},
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	futures := []*queue.ProduceFuture{p.ProduceItemsAsync(ctx, priorityRequest(1, "low-0"))}
+
+	// The low priority lane is full, but the high priority lane has room
+	err = p.TryProduceItems(ctx, priorityRequest(1, "low-1"))
+	assert.True(t, errors.Is(err, queue.ErrQueueFull))
+	futures = append(futures, p.ProduceItemsAsync(ctx, priorityRequest(0, "high-0")))
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(p)
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	depth := make(map[string]float64)
+	for _, f := range families {
+		if f.GetName() != "queue_lane_depth" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			depth[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+	assert.Equal(t, map[string]float64{"high": 1, "low": 1}, depth)
+
+	require.NoError(t, p.Close(ctx))
+	for _, f := range futures {
+		assert.NoError(t, f.Wait(ctx))
+	}
+
+	families, err = registry.Gather()
+	require.NoError(t, err)
+	var waited uint64
+	for _, f := range families {
+		if f.GetName() == "queue_lane_wait_seconds" {
+			for _, m := range f.GetMetric() {
+				waited += m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	assert.Equal(t, uint64(2), waited)
+}
@@ -0,0 +1,101 @@
+package queue
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+)
+
+// producer implements the methods shared by every pattern on top of put, such that
+// a pattern only implements put and Close. Each request is checked against the
+// config and reserves room in the limiter before it is passed to put.
+type producer struct {
+	// put places the request in the queue of the pattern. If the queue is full, put
+	// waits for room until the ctx of the request is done, unless block is false.
+	put func(r *Request, block bool) error
+	// rejected is called with each request which could not be queued, if set
+	rejected func(r *Request, err error)
+	limiter  *limiter
+	conf     *BatcherConfig
+}
+
+func newProducer(conf *BatcherConfig, put func(r *Request, block bool) error) producer {
+	return producer{
+		put:     put,
+		limiter: newLimiter(conf.MaxQueuedBytes),
+		conf:    conf,
+	}
+}
+
+// ProduceItems queues the request and waits for it to be sent. If the queue is
+// full, ProduceItems waits for room until ctx is done.
+func (p *producer) ProduceItems(ctx context.Context, req *pb.ProduceRequest) error {
+	r := newRequest(ctx, req)
+	if err := p.enqueue(r, true); err != nil {
+		return err
+	}
+	return r.wait()
+}
+
+// TryProduceItems is identical to ProduceItems except it returns ErrQueueFull
+// instead of waiting for room when the queue is full.
+func (p *producer) TryProduceItems(ctx context.Context, req *pb.ProduceRequest) error {
+	r := newRequest(ctx, req)
+	if err := p.enqueue(r, false); err != nil {
+		return err
+	}
+	return r.wait()
+}
+
+// ProduceItemsAsync queues the request and returns a future which completes once
+// the request is sent. If the queue is full, ProduceItemsAsync waits for room until
+// ctx is done.
+func (p *producer) ProduceItemsAsync(ctx context.Context, req *pb.ProduceRequest) *ProduceFuture {
+	r := newRequest(ctx, req)
+	if err := p.enqueue(r, true); err != nil {
+		r.complete(err)
+	}
+	return &ProduceFuture{r: r}
+}
+
+// ProduceItemsFunc queues the request and calls fn once the request completes. fn
+// is called by the goroutine which sends the batch and must not block.
+func (p *producer) ProduceItemsFunc(ctx context.Context, req *pb.ProduceRequest, fn func(err error)) {
+	r := newRequest(ctx, req)
+	r.callback = fn
+	if err := p.enqueue(r, true); err != nil {
+		r.complete(err)
+	}
+}
+
+func (p *producer) enqueue(r *Request, block bool) error {
+	parts, err := p.conf.checkRequest(r)
+	if parts != nil {
+		// Queue each part of a request larger than a batch in order
+		return newSplit(r, len(parts)).enqueue(parts, func(_ int, part *Request) error {
+			return p.enqueue(part, block)
+		})
+	}
+	if err == nil {
+		err = p.limiter.acquire(r, block)
+	}
+	if err == nil {
+		if err = p.put(r, block); err != nil {
+			r.release()
+		}
+	}
+	if err != nil && p.rejected != nil {
+		p.rejected(r, err)
+	}
+	return err
+}
+
+// Describe fetches prometheus metrics to be registered
+func (p *producer) Describe(ch chan<- *prometheus.Desc) {
+	p.conf.metrics.Describe(ch)
+}
+
+// Collect fetches the queue metrics for use by prometheus
+func (p *producer) Collect(ch chan<- prometheus.Metric) {
+	p.conf.metrics.Collect(ch)
+}
@@ -2,95 +2,133 @@ package queue
 
 import (
 	"context"
+	"github.com/kapetan-io/tackle/set"
+	"github.com/thrawn01/queue-patterns.go/batch"
 	pb "github.com/thrawn01/queue-patterns.go/proto"
 	"sync"
-	"time"
 )
 
 type QueratorNoAlloc struct {
-	requestCh  chan *Request
-	wg         sync.WaitGroup
-	done       chan struct{}
-	client     *Client
-	batchLimit int
+	producer
+	requestCh chan *Request
+	wg        sync.WaitGroup
+	done      chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeMu   sync.RWMutex
+	closeCtx  context.Context
+	closed    bool
+	// queue is used to linger with the helpers of the batch package
+	queue batch.QueueConfig[*Request]
+	conf  BatcherConfig
 }
 
-func NewQueratorNoAlloc(limit int, c *Client) *QueratorNoAlloc {
+func NewQueratorNoAlloc(conf BatcherConfig) (*QueratorNoAlloc, error) {
+	set.Default(&conf.BatchLimit, DefaultBatchLimit)
+	set.Default(&conf.RequestBufferSize, conf.BatchLimit*10)
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+
 	ch := &QueratorNoAlloc{
-		requestCh:  make(chan *Request, limit*10),
-		done:       make(chan struct{}),
-		batchLimit: limit,
-		client:     c,
+		requestCh: make(chan *Request, conf.RequestBufferSize),
+		done:      make(chan struct{}),
+		queue:     conf.queueConfig(),
+		conf:      conf,
 	}
+	ch.producer = newProducer(&ch.conf, ch.put)
+	ch.ctx, ch.cancel = context.WithCancel(context.Background())
 
 	ch.wg.Add(1)
 	go ch.run()
 
-	return ch
+	return ch, nil
 }
 
 func (m *QueratorNoAlloc) run() {
 	defer m.wg.Done()
-	var batch pb.ProduceRequest
-	requests := make([]*Request, 10_000)
-	batch.Items = make([]*pb.ProduceItem, 0, 10_000)
-	var idx int
+	var s sender
+	requests := make([]*Request, 0, m.conf.PreallocSize)
+	s.batch.Items = make([]*pb.ProduceItem, 0, m.conf.PreallocSize)
 
 	for {
 		select {
 		// Collect all the requests into a local queue
 		case req := <-m.requestCh:
-			batch.Items = append(batch.Items, req.Request.Items...)
-			requests[idx] = req
-			idx++
+			// Never collect more requests than we have preallocated
+			requests = append(requests, req)
+			requests = batch.Drain(m.requestCh, requests, cap(requests))
+			if m.conf.lingering() {
+				requests = m.queue.Linger(m.requestCh, m.done, requests, requests[0].queued, cap(requests))
+			}
 
-		EMPTY:
+			flush(m.ctx, m.conf, &s, requests, m.conf.reason(requests, cap(requests)))
+			requests = requests[:0]
+		case <-m.done:
 			for {
-				select {
-				case req := <-m.requestCh:
-					batch.Items = append(batch.Items, req.Request.Items...)
-					requests[idx] = req
-					idx++
-				default:
-					break EMPTY
+				requests = batch.Drain(m.requestCh, requests[:0], cap(requests))
+				if len(requests) == 0 {
+					return
 				}
+				flush(m.closeCtx, m.conf, &s, requests, batch.ReasonClose)
 			}
-
-			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-			err := m.client.ProduceItems(ctx, &batch)
-			for i := 0; i < idx; i++ {
-				requests[i].Err = err
-				close(requests[i].ReadyCh)
-			}
-			cancel()
-			batch.Items = batch.Items[:0]
-			//requests = requests[:0]
-			idx = 0
-		case <-m.done:
-			return
 		}
 	}
 }
 
-func (m *QueratorNoAlloc) Close(_ context.Context) error {
+// Close drains the channel and flushes the final batches
+func (m *QueratorNoAlloc) Close(ctx context.Context) error {
+	m.closeMu.Lock()
+	if m.closed {
+		m.closeMu.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	m.closeMu.Unlock()
+
+	m.closeCtx = ctx
 	close(m.done)
-	m.wg.Wait()
-	return nil
+	batch.Wait(ctx, &m.wg, m.cancel)
+	return ctx.Err()
 }
 
+// ProduceItems queues the request and waits for it to be sent. If the queue is
+// full, ProduceItems waits for room until ctx is done.
 func (m *QueratorNoAlloc) ProduceItems(ctx context.Context, req *pb.ProduceRequest) error {
-	r := Request{
-		ReadyCh: make(chan struct{}),
-		Request: req,
-		Context: ctx,
-	}
+	return m.produce(ctx, req, true)
+}
 
-	m.requestCh <- &r
+// TryProduceItems is identical to ProduceItems except it returns ErrQueueFull
+// instead of waiting for room when the queue is full.
+func (m *QueratorNoAlloc) TryProduceItems(ctx context.Context, req *pb.ProduceRequest) error {
+	return m.produce(ctx, req, false)
+}
 
-	select {
-	case <-r.ReadyCh:
-		return r.Err
-	case <-ctx.Done():
-		return ctx.Err()
+// produce queues a recycled request and waits for it to be sent, such that the
+// caller does not allocate while the buffers of the writer are large enough.
+func (m *QueratorNoAlloc) produce(ctx context.Context, req *pb.ProduceRequest, block bool) error {
+	r := getRequest(ctx, req)
+	if err := m.enqueue(r, block); err != nil {
+		// The writer never received the request, so release its reference as well
+		r.recycle()
+		r.recycle()
+		return err
 	}
+	err := r.wait()
+	r.recycle()
+	return err
+}
+
+func (m *QueratorNoAlloc) put(r *Request, block bool) error {
+	m.closeMu.RLock()
+	defer m.closeMu.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+	m.conf.metrics.queued()
+	if err := batch.Send(r.Context, m.requestCh, r, block); err != nil {
+		m.conf.metrics.unqueued()
+		return err
+	}
+	return nil
 }
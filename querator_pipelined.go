@@ -0,0 +1,146 @@
+package queue
+
+import (
+	"context"
+	"github.com/kapetan-io/tackle/set"
+	"github.com/thrawn01/queue-patterns.go/batch"
+	"math"
+	"sync"
+)
+
+// QueratorPipelined collects requests the same way as Querator, but instead of
+// waiting for each batch to complete before collecting the next, it allows up to
+// PipelineDepth batches to be in flight to the server at once. Requests continue
+// to be collected while batches are in flight.
+//
+// See WithNoTLSConns() to allow a connection for each batch in flight.
+type QueratorPipelined struct {
+	producer
+	requestCh chan *Request
+	inFlight  chan struct{}
+	// last is closed once the most recently dispatched batch has completed
+	last     chan struct{}
+	wg       sync.WaitGroup
+	done     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	closeMu  sync.RWMutex
+	closeCtx context.Context
+	closed   bool
+	// queue is used to linger with the helpers of the batch package
+	queue batch.QueueConfig[*Request]
+	conf  BatcherConfig
+}
+
+func NewQueratorPipelined(conf BatcherConfig) (*QueratorPipelined, error) {
+	set.Default(&conf.PipelineDepth, DefaultPipelineDepth)
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+
+	ch := &QueratorPipelined{
+		requestCh: make(chan *Request, conf.RequestBufferSize),
+		inFlight:  make(chan struct{}, conf.PipelineDepth),
+		done:      make(chan struct{}),
+		queue:     conf.queueConfig(),
+		conf:      conf,
+	}
+	ch.producer = newProducer(&ch.conf, ch.put)
+	ch.ctx, ch.cancel = context.WithCancel(context.Background())
+
+	ch.wg.Add(1)
+	go ch.run()
+
+	return ch, nil
+}
+
+func (m *QueratorPipelined) run() {
+	defer m.wg.Done()
+
+	for {
+		select {
+		// Collect all the requests into a local queue
+		case req := <-m.requestCh:
+			requests := make([]*Request, 0, len(m.requestCh)+1)
+			requests = append(requests, req)
+			requests = batch.Drain(m.requestCh, requests, m.conf.BatchLimit)
+			if m.conf.lingering() {
+				requests = m.queue.Linger(m.requestCh, m.done, requests, requests[0].queued, m.conf.BatchLimit)
+			}
+			m.dispatch(m.ctx, requests, m.conf.reason(requests, m.conf.BatchLimit))
+		case <-m.done:
+			m.dispatch(m.closeCtx, batch.Drain(m.requestCh, nil, math.MaxInt), batch.ReasonClose)
+			return
+		}
+	}
+}
+
+// dispatch splits the requests into batches and sends each batch in a separate
+// goroutine, blocking while PipelineDepth batches are already in flight.
+func (m *QueratorPipelined) dispatch(ctx context.Context, requests []*Request, reason batch.Reason) {
+	for len(requests) != 0 {
+		n := nextBatch(m.conf, requests)
+		pending := requests[:n]
+		requests = requests[n:]
+
+		// Wait for room in the pipeline before committing the pending
+		m.inFlight <- struct{}{}
+		pending = commit(m.conf, pending)
+		if len(pending) == 0 {
+			<-m.inFlight
+			continue
+		}
+		m.conf.metrics.sent(pending, reason)
+
+		prev, done := m.last, make(chan struct{})
+		m.last = done
+
+		m.wg.Add(1)
+		go func() {
+			defer func() {
+				close(done)
+				<-m.inFlight
+				m.wg.Done()
+			}()
+
+			var s sender
+			pending, err := produce(ctx, m.conf, &s, pending)
+
+			// Wait for the previous pending to complete before completing this one
+			if m.conf.OrderedCompletion && prev != nil {
+				<-prev
+			}
+			completeBatch(m.conf, pending, &s.res, err)
+		}()
+	}
+}
+
+// Close dispatches what remains and waits for every batch in flight
+func (m *QueratorPipelined) Close(ctx context.Context) error {
+	m.closeMu.Lock()
+	if m.closed {
+		m.closeMu.Unlock()
+		return ErrClosed
+	}
+	m.closed = true
+	m.closeMu.Unlock()
+
+	m.closeCtx = ctx
+	close(m.done)
+	batch.Wait(ctx, &m.wg, m.cancel)
+	return ctx.Err()
+}
+
+func (m *QueratorPipelined) put(r *Request, block bool) error {
+	m.closeMu.RLock()
+	defer m.closeMu.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+	m.conf.metrics.queued()
+	if err := batch.Send(r.Context, m.requestCh, r, block); err != nil {
+		m.conf.metrics.unqueued()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package queue_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueratorPipelined(t *testing.T) {
+	t.Run("InFlight", func(t *testing.T) {
+		s := newTestServer(t, queue.Config{RequestSleep: 50 * time.Millisecond})
+		c, err := queue.NewClient(queue.WithNoTLSConns(strings.TrimPrefix(s.URL, "http://"), 4))
+		require.NoError(t, err)
+
+		p, err := queue.NewQueratorPipelined(queue.BatcherConfig{
+			Client:        c,
+			BatchLimit:    1,
+			PipelineDepth: 4,
+		})
+		require.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				assert.NoError(t, p.ProduceItems(context.Background(), produceRequest(fmt.Sprintf("item-%d", i))))
+			}(i)
+		}
+		wg.Wait()
+		require.NoError(t, p.Close(context.Background()))
+
+		assert.Len(t, s.Items(), 20)
+		assert.Greater(t, s.MaxInFlight(), 1)
+		assert.LessOrEqual(t, s.MaxInFlight(), 4)
+	})
+
+	for _, tc := range []struct {
+		name    string
+		ordered bool
+		waits   bool
+	}{
+		{name: "Unordered", ordered: false, waits: false},
+		{name: "Ordered", ordered: true, waits: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, queue.Config{RequestSleep: time.Millisecond})
+			s.SetDelay(func(batch []string) time.Duration {
+				if batch[0] == "slow" {
+					return 200 * time.Millisecond
+				}
+				return 0
+			})
+			c, err := queue.NewClient(queue.WithNoTLSConns(strings.TrimPrefix(s.URL, "http://"), 2))
+			require.NoError(t, err)
+
+			p, err := queue.NewQueratorPipelined(queue.BatcherConfig{
+				Client:            c,
+				BatchLimit:        1,
+				PipelineDepth:     2,
+				OrderedCompletion: tc.ordered,
+			})
+			require.NoError(t, err)
+
+			slow := make(chan error, 1)
+			go func() {
+				slow <- p.ProduceItems(context.Background(), produceRequest("slow"))
+			}()
+			time.Sleep(20 * time.Millisecond)
+
+			// The fast batch finishes first, but should only complete after the slow
+			// batch if completion is ordered.
+			start := time.Now()
+			require.NoError(t, p.ProduceItems(context.Background(), produceRequest("fast")))
+			if tc.waits {
+				assert.Greater(t, time.Since(start), 100*time.Millisecond)
+			} else {
+				assert.Less(t, time.Since(start), 100*time.Millisecond)
+			}
+
+			require.NoError(t, <-slow)
+			require.NoError(t, p.Close(context.Background()))
+		})
+	}
+}
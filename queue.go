@@ -2,16 +2,398 @@ package queue
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/duh-rpc/duh-go"
+	"github.com/kapetan-io/tackle/clock"
+	"github.com/kapetan-io/tackle/set"
 	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	DefaultBatchLimit    = 1_000
+	DefaultFlushInterval = 15 * time.Millisecond
+	DefaultSendTimeout   = time.Second
+	DefaultPreallocSize  = 10_000
+	DefaultMaxBatchBytes = duh.MegaByte * 10
+	DefaultPipelineDepth = 4
+	DefaultShards        = 8
+	DefaultTenantIdle    = time.Minute
+)
+
+// DeadlinePolicy decides the deadline of each batch sent to the server
+type DeadlinePolicy int
+
+const (
+	// DeadlineEarliest uses the earliest deadline among the requests in the batch
+	DeadlineEarliest DeadlinePolicy = iota
+	// DeadlineLatest uses the latest deadline among the requests in the batch
+	DeadlineLatest
+	// DeadlineFixed ignores the deadlines of the requests and always uses SendTimeout
+	DeadlineFixed
+)
+
+type BatcherConfig struct {
+	// Client is the client used to send each batch to the server
+	Client *Client
+	// BatchLimit is the maximum number of items sent in a single batch. Batches which
+	// exceed this limit are split into multiple batches (Default: 1_000)
+	BatchLimit int
+	// MaxBatchBytes is the maximum encoded size in bytes of a single batch. Must not
+	// exceed MaxRequestBytes (Default: 10MB)
+	MaxBatchBytes int
+	// FlushInterval is how often the interval based patterns flush the
+	// current batch to the server (Default: 15ms)
+	FlushInterval time.Duration
+	// FixedRate causes the interval based patterns to flush every FlushInterval on
+	// a fixed rate which keeps its phase, instead of waiting FlushInterval after
+	// each flush completes.
+	FixedRate bool
+	// SendTimeout is the timeout applied to each batch sent to the server when
+	// DeadlinePolicy is DeadlineFixed, or when no request in the batch has a
+	// deadline (Default: 1s)
+	SendTimeout time.Duration
+	// DeadlinePolicy decides how the deadline of each batch is derived from the
+	// deadlines of the requests it carries (Default: DeadlineEarliest)
+	DeadlinePolicy DeadlinePolicy
+	// RequestBufferSize is the capacity of the buffer producers place requests into
+	// before the writer collects them (Default: BatchLimit)
+	RequestBufferSize int
+	// MaxQueuedBytes is the maximum encoded size of all the requests queued or in
+	// flight to the server. Once reached, ProduceItems waits for room and
+	// TryProduceItems returns ErrQueueFull. (Default: unlimited)
+	MaxQueuedBytes int
+	// PreallocSize is the number of requests and items preallocated by patterns which
+	// reuse their batch buffers (Default: 10_000)
+	PreallocSize int
+	// MaxLinger enables linger mode when greater than zero. In linger mode every
+	// pattern waits for more requests until the batch reaches MinBatchItems or
+	// MinBatchBytes, or the oldest request in the batch has waited MaxLinger,
+	// whichever comes first. (Default: disabled)
+	MaxLinger time.Duration
+	// MinBatchItems is the number of items which causes a batch to flush
+	// immediately (Default: BatchLimit)
+	MinBatchItems int
+	// MinBatchBytes is the encoded size of the items which causes a batch to
+	// flush immediately (Default: MaxBatchBytes)
+	MinBatchBytes int
+	// PipelineDepth is the maximum number of batches pipelined patterns will have
+	// in flight to the server at once. (Default: 4)
+	PipelineDepth int
+	// OrderedCompletion causes pipelined patterns to complete batches in the order
+	// they were sent, even if a later batch finishes first.
+	OrderedCompletion bool
+	// Lanes are the priority lanes of the Prioritized pattern, highest priority first.
+	// The Priority of a request is the index of its lane. (Default: a single lane)
+	Lanes []LaneConfig
+	// LanePolicy is the order the Prioritized pattern drains the lanes when building
+	// a batch. (Default: LaneStrict)
+	LanePolicy LanePolicy
+	// TenantLimit is the number of requests each tenant may have queued in the Fair
+	// pattern before its producers must wait for room. (Default: unlimited)
+	TenantLimit int
+	// TenantQuantum is the number of items each tenant may add to a batch in each
+	// round of the Fair pattern. (Default: BatchLimit / 10)
+	TenantQuantum int
+	// TenantIdle is how long a tenant of the Fair pattern may have nothing queued
+	// before the tenant and its metrics are dropped. (Default: 1m)
+	TenantIdle time.Duration
+	// Shards is the number of independent writers the Sharded pattern hashes the
+	// keys of the requests onto. (Default: 8)
+	Shards int
+	// Stripes is the number of buffers the Striped pattern collects requests into.
+	// (Default: runtime.GOMAXPROCS(0))
+	Stripes int
+	// Name is added as the 'pattern' label of every metric the pattern collects, such
+	// that multiple patterns may register with the same prometheus.Registerer.
+	// (Default: no label)
+	Name string
+	// Retry is the policy used to retry batches which fail to send. Retries are never
+	// attempted beyond the deadline of the batch. The Client makes a single attempt
+	// for each batch, such that only this policy ever retries a batch. If MaxAttempts
+	// is zero, the Retry of the Client is used. (Default: ClientConfig.Retry)
+	Retry RetryPolicy
+
+	// metrics are shared by every writer of the pattern
+	metrics *metrics
+	// order if set fails the requests queued behind a failed batch with the same key
+	order *keyOrder
+}
+
+// validate sets the defaults for any config options not provided and returns
+// an error if the resulting config is invalid.
+func (c *BatcherConfig) validate() error {
+	if c.Client == nil {
+		return errors.New("conf.Client is nil; must provide a Client")
+	}
+
+	set.Default(&c.BatchLimit, DefaultBatchLimit)
+	set.Default(&c.MaxBatchBytes, DefaultMaxBatchBytes)
+	set.Default(&c.FlushInterval, DefaultFlushInterval)
+	set.Default(&c.SendTimeout, DefaultSendTimeout)
+	set.Default(&c.RequestBufferSize, c.BatchLimit)
+	set.Default(&c.PreallocSize, DefaultPreallocSize)
+	set.Default(&c.MinBatchItems, c.BatchLimit)
+	set.Default(&c.MinBatchBytes, c.MaxBatchBytes)
+	if c.metrics == nil {
+		c.metrics = newMetrics(c.constLabels())
+	}
+
+	if c.BatchLimit < 0 {
+		return errors.New("conf.BatchLimit is invalid; must be greater than zero")
+	}
+	if c.MaxBatchBytes < 0 || c.MaxBatchBytes > MaxRequestBytes {
+		return fmt.Errorf("conf.MaxBatchBytes is invalid; must be greater than zero and "+
+			"less than '%d'", MaxRequestBytes)
+	}
+	if c.FlushInterval < 0 {
+		return errors.New("conf.FlushInterval is invalid; must be greater than zero")
+	}
+	if c.SendTimeout < 0 {
+		return errors.New("conf.SendTimeout is invalid; must be greater than zero")
+	}
+	if c.DeadlinePolicy < DeadlineEarliest || c.DeadlinePolicy > DeadlineFixed {
+		return fmt.Errorf("conf.DeadlinePolicy is invalid; unknown policy '%d'", c.DeadlinePolicy)
+	}
+	if c.RequestBufferSize < 0 {
+		return errors.New("conf.RequestBufferSize is invalid; must be greater than zero")
+	}
+	if c.MaxQueuedBytes < 0 {
+		return errors.New("conf.MaxQueuedBytes is invalid; must be greater than zero")
+	}
+	if c.PreallocSize < 0 {
+		return errors.New("conf.PreallocSize is invalid; must be greater than zero")
+	}
+	if c.MaxLinger < 0 {
+		return errors.New("conf.MaxLinger is invalid; must be greater than zero")
+	}
+	if c.MinBatchItems < 0 || c.MinBatchItems > c.BatchLimit {
+		return errors.New("conf.MinBatchItems is invalid; must be greater than zero and " +
+			"less than BatchLimit")
+	}
+	if c.MinBatchBytes < 0 || c.MinBatchBytes > c.MaxBatchBytes {
+		return errors.New("conf.MinBatchBytes is invalid; must be greater than zero and " +
+			"less than MaxBatchBytes")
+	}
+	if c.PipelineDepth < 0 {
+		return errors.New("conf.PipelineDepth is invalid; must be greater than zero")
+	}
+	if c.TenantLimit < 0 {
+		return errors.New("conf.TenantLimit is invalid; must be greater than zero")
+	}
+	if c.TenantQuantum < 0 {
+		return errors.New("conf.TenantQuantum is invalid; must be greater than zero")
+	}
+	if c.TenantIdle < 0 {
+		return errors.New("conf.TenantIdle is invalid; must be greater than zero")
+	}
+	if c.Shards < 0 {
+		return errors.New("conf.Shards is invalid; must be greater than zero")
+	}
+	if c.Stripes < 0 {
+		return errors.New("conf.Stripes is invalid; must be greater than zero")
+	}
+	if c.Retry.MaxAttempts == 0 {
+		c.Retry = c.Client.conf.Retry
+	}
+	return c.Retry.validate()
+}
+
+const (
+	statePending int32 = iota
+	stateCommitted
+	stateCancelled
+)
+
+// Request is a single call to ProduceItems waiting to be sent in a batch.
+//
+// A request is committed to the wire once the writer has placed it into a batch
+// which is about to be sent to the server. Until then, cancelling the callers
+// ctx withdraws the request and its items are never sent. Once committed, the
+// items may reach the server even if the caller has given up, in which case the
+// caller receives ErrCommitted along with the ctx error.
 type Request struct {
 	// Context is the context of the request
 	Context context.Context
 	// The request struct for this method
 	Request *pb.ProduceRequest
-	// Used to wait for this request to complete
+	// Used to wait for this request to complete. Closed once the request completes,
+	// unless the request was recycled by getRequest(), in which case it is signalled.
 	ReadyCh chan struct{}
 	// The error to be returned to the caller
 	Err error
+	// The encoded size of the items in the request
+	size int
+	// The time the request was queued
+	queued time.Time
+	// One of statePending, stateCommitted or stateCancelled
+	state atomic.Int32
+	// The limiter the request has reserved room in, if any
+	limiter *limiter
+	// callback if set is called once the request completes
+	callback func(err error)
+	// next links the request to the next request in the MPSC queue
+	next atomic.Pointer[Request]
+	// leadCh if set receives a signal when the caller is appointed the Combiner
+	leadCh chan struct{}
+	// raw if set are the items of the request encoded by the caller
+	raw []byte
+	// parent if set is the request this request is a part of
+	parent *Request
+	// pooled is true if the request is recycled once the caller and the writer
+	// have both released it, and refs is the number which have yet to release it.
+	pooled bool
+	refs   atomic.Int32
+}
+
+func newRequest(ctx context.Context, req *pb.ProduceRequest) *Request {
+	return &Request{
+		ReadyCh: make(chan struct{}),
+		size:    proto.Size(req),
+		queued:  clock.Now(),
+		Request: req,
+		Context: ctx,
+	}
+}
+
+// requestPool recycles the requests of callers which wait for their request to
+// complete, along with the ReadyCh of each request.
+var requestPool = sync.Pool{
+	New: func() any {
+		return &Request{ReadyCh: make(chan struct{}, 1), pooled: true}
+	},
+}
+
+// getRequest is identical to newRequest except the request is recycled, such that
+// queueing the request does not allocate. The request is referenced by both the
+// caller and the writer, each of which must call recycle() once done with it. The
+// writer releases its reference when it completes the request.
+func getRequest(ctx context.Context, req *pb.ProduceRequest) *Request {
+	r := requestPool.Get().(*Request)
+	r.Context = ctx
+	r.Request = req
+	r.size = proto.Size(req)
+	r.queued = clock.Now()
+	r.refs.Store(2)
+	return r
+}
+
+// recycle releases a reference to a request from getRequest(). The request is
+// returned to the pool once both the caller and the writer have released it.
+func (r *Request) recycle() {
+	if !r.pooled || r.refs.Add(-1) != 0 {
+		return
+	}
+	// The signal is never received if the caller stopped waiting first
+	select {
+	case <-r.ReadyCh:
+	default:
+	}
+	r.Context = nil
+	r.Request = nil
+	r.Err = nil
+	r.state.Store(statePending)
+	r.limiter = nil
+	r.callback = nil
+	r.next.Store(nil)
+	r.leadCh = nil
+	r.raw = nil
+	r.parent = nil
+	requestPool.Put(r)
+}
+
+// checkRequest returns the indexes of the items of the request split into parts
+// which each fit into a single batch, or nil if the request fits into a batch as is.
+// Returns ErrTooLarge if an item could never fit into a single batch.
+func (c *BatcherConfig) checkRequest(r *Request) ([][]int, error) {
+	if len(r.Request.Items) <= c.BatchLimit && r.size <= c.MaxBatchBytes {
+		return nil, nil
+	}
+
+	sizes := make([]int, len(r.Request.Items))
+	overhead := r.size
+	for i, item := range r.Request.Items {
+		sizes[i] = protowire.SizeTag(itemsField) + protowire.SizeBytes(proto.Size(item))
+		overhead -= sizes[i]
+	}
+
+	// overhead is the size of every field of the request other than its items
+	var parts [][]int
+	var part []int
+	size := overhead
+	for i, n := range sizes {
+		if overhead+n > c.MaxBatchBytes {
+			return nil, fmt.Errorf("%w; item '%d' is '%d' bytes, MaxBatchBytes is '%d'",
+				ErrTooLarge, i, n, c.MaxBatchBytes)
+		}
+		if len(part) == c.BatchLimit || size+n > c.MaxBatchBytes {
+			parts = append(parts, part)
+			part, size = nil, overhead
+		}
+		part = append(part, i)
+		size += n
+	}
+	return append(parts, part), nil
+}
+
+// commit marks the request as committed to the wire. Returns false if the
+// request was withdrawn by the caller or its context is done.
+func (r *Request) commit() bool {
+	if r.Context.Err() != nil {
+		r.state.CompareAndSwap(statePending, stateCancelled)
+		return false
+	}
+	// A part may only be committed if the requests it is a part of were not withdrawn
+	for p := r.parent; p != nil; p = p.parent {
+		if !p.state.CompareAndSwap(statePending, stateCommitted) && p.state.Load() != stateCommitted {
+			r.state.CompareAndSwap(statePending, stateCancelled)
+			return false
+		}
+	}
+	return r.state.CompareAndSwap(statePending, stateCommitted)
+}
+
+// wait blocks until the request completes or the context of the request is done.
+// If the context is done before the request was committed, the request is withdrawn.
+func (r *Request) wait() error {
+	select {
+	case <-r.ReadyCh:
+		return r.Err
+	case <-r.Context.Done():
+		// The request may have already been withdrawn by commit()
+		if r.state.CompareAndSwap(statePending, stateCancelled) || r.state.Load() == stateCancelled {
+			return r.Context.Err()
+		}
+		return fmt.Errorf("%w; %w", ErrCommitted, r.Context.Err())
+	}
+}
+
+// complete sets the error to be returned to the caller and notifies the caller
+// the request has completed. The writer must not use the request once completed,
+// as a recycled request may be reused by another caller.
+func (r *Request) complete(err error) {
+	r.release()
+	r.Err = err
+	if r.pooled {
+		r.ReadyCh <- struct{}{}
+	} else {
+		close(r.ReadyCh)
+	}
+	if r.callback != nil {
+		r.callback(err)
+	}
+	r.recycle()
+}
+
+// release returns the room reserved by the request in the limiter
+func (r *Request) release() {
+	if r.limiter != nil {
+		r.limiter.release(r.size)
+		r.limiter = nil
+	}
 }
@@ -0,0 +1,151 @@
+package queue_test
+
+import (
+	"bytes"
+	"github.com/duh-rpc/duh-go"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer records every batch received by the HTTPHandler
+type testServer struct {
+	*httptest.Server
+	handler  *queue.HTTPHandler
+	mutex    sync.Mutex
+	batches  [][]string
+	requests int
+	failures int
+	failCode int
+	inFlight int
+	// maxInFlight is the maximum number of requests the server handled at once
+	maxInFlight int
+	// delay if set returns how long the server should wait before handling the batch
+	delay func(batch []string) time.Duration
+}
+
+func newTestServer(t *testing.T, conf queue.Config) *testServer {
+	s := &testServer{handler: queue.NewHTTPHandler(nil, conf)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.ServeHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// FailNext causes the next n requests to the server to fail with the provided code
+func (s *testServer) FailNext(n, code int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures, s.failCode = n, code
+}
+
+// SetDelay sets a function which returns how long the server should wait before
+// handling each batch
+func (s *testServer) SetDelay(fn func(batch []string) time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.delay = fn
+}
+
+// MaxInFlight returns the maximum number of requests the server handled at once
+func (s *testServer) MaxInFlight() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.maxInFlight
+}
+
+// Requests returns the total number of requests the server received
+func (s *testServer) Requests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.requests++
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	defer func() {
+		s.mutex.Lock()
+		s.inFlight--
+		s.mutex.Unlock()
+	}()
+	if s.failures > 0 {
+		s.failures--
+		s.mutex.Unlock()
+		duh.ReplyWithCode(w, r, s.failCode, nil, "injected failure")
+		return
+	}
+	s.mutex.Unlock()
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		duh.ReplyWithCode(w, r, duh.CodeInternalError, nil, err.Error())
+		return
+	}
+
+	var req pb.ProduceRequest
+	if err := proto.Unmarshal(b, &req); err == nil {
+		var batch []string
+		for _, item := range req.Items {
+			batch = append(batch, string(item.Bytes))
+		}
+		s.mutex.Lock()
+		s.batches = append(s.batches, batch)
+		delay := s.delay
+		s.mutex.Unlock()
+
+		if delay != nil {
+			time.Sleep(delay(batch))
+		}
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(b))
+	s.handler.ServeHTTP(w, r)
+}
+
+// Items returns every item received by the server in the order received
+func (s *testServer) Items() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var items []string
+	for _, batch := range s.batches {
+		items = append(items, batch...)
+	}
+	return items
+}
+
+// Batches returns every batch received by the server in the order received
+func (s *testServer) Batches() [][]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([][]string(nil), s.batches...)
+}
+
+func (s *testServer) ClientConfig() queue.ClientConfig {
+	return queue.WithNoTLS(strings.TrimPrefix(s.URL, "http://"))
+}
+
+func (s *testServer) Client(t *testing.T) *queue.Client {
+	c, err := queue.NewClient(s.ClientConfig())
+	require.NoError(t, err)
+	return c
+}
+
+func produceRequest(items ...string) *pb.ProduceRequest {
+	var req pb.ProduceRequest
+	for _, item := range items {
+		req.Items = append(req.Items, &pb.ProduceItem{Bytes: []byte(item)})
+	}
+	return &req
+}
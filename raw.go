@@ -0,0 +1,74 @@
+package queue
+
+import (
+	"context"
+	"github.com/kapetan-io/tackle/clock"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// itemsField is the field number of the repeated items of a ProduceRequest
+var itemsField = (&pb.ProduceRequest{}).ProtoReflect().Descriptor().Fields().ByName("items").Number()
+
+// EncodeItems appends the items to dst encoded as the repeated items field of a
+// ProduceRequest. As a repeated field is encoded by concatenating its entries, the
+// encoded items of many requests may be appended together to form a single
+// ProduceRequest without marshaling the items again.
+func EncodeItems(dst []byte, items []*pb.ProduceItem) ([]byte, error) {
+	var err error
+	for _, item := range items {
+		dst = protowire.AppendTag(dst, itemsField, protowire.BytesType)
+		dst = protowire.AppendVarint(dst, uint64(proto.Size(item)))
+		// The size of the item was cached by proto.Size()
+		dst, err = proto.MarshalOptions{UseCachedSize: true}.MarshalAppend(dst, item)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// newRawRequest is identical to newRequest except the items of the request are
+// encoded by the caller, such that the writer does not marshal them again.
+func newRawRequest(ctx context.Context, req *pb.ProduceRequest) (*Request, error) {
+	raw, err := EncodeItems(nil, req.Items)
+	if err != nil {
+		return nil, err
+	}
+	return &Request{
+		ReadyCh: make(chan struct{}),
+		// Only the encoded items are sent to the server
+		size:    len(raw),
+		raw:     raw,
+		queued:  clock.Now(),
+		Request: req,
+		Context: ctx,
+	}, nil
+}
+
+// hasRaw returns true if any of the requests carry items encoded by the caller
+func hasRaw(requests []*Request) bool {
+	for _, req := range requests {
+		if req.raw != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// appendRaw appends the encoded items of each request to buf, encoding the items of
+// any request which was not encoded by the caller.
+func appendRaw(buf []byte, requests []*Request) ([]byte, error) {
+	var err error
+	for _, req := range requests {
+		if req.raw != nil {
+			buf = append(buf, req.raw...)
+			continue
+		}
+		if buf, err = EncodeItems(buf, req.Request.Items); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
@@ -0,0 +1,101 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"github.com/duh-rpc/duh-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"google.golang.org/protobuf/proto"
+	"testing"
+	"time"
+)
+
+func TestEncodeItems(t *testing.T) {
+	req := produceRequest("one", "two", "three")
+	req.Items[1].Key = "key"
+
+	// The encoded items of many requests concatenate into a single request
+	raw, err := queue.EncodeItems(nil, req.Items[:1])
+	require.NoError(t, err)
+	raw, err = queue.EncodeItems(raw, req.Items[1:])
+	require.NoError(t, err)
+
+	var decoded pb.ProduceRequest
+	require.NoError(t, proto.Unmarshal(raw, &decoded))
+	assert.True(t, proto.Equal(req, &decoded))
+}
+
+func TestClientProduceRaw(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+	c := s.Client(t)
+
+	raw, err := queue.EncodeItems(nil, produceRequest("one", "two").Items)
+	require.NoError(t, err)
+	require.NoError(t, c.ProduceRaw(context.Background(), raw, 2))
+	assert.Equal(t, []string{"one", "two"}, s.Items())
+
+	raw, err = queue.EncodeItems(nil, produceRequest("one", "").Items)
+	require.NoError(t, err)
+	var itemErr *queue.ItemError
+	require.True(t, errors.As(c.ProduceRaw(context.Background(), raw, 2), &itemErr))
+	assert.Equal(t, 1, itemErr.Index)
+	assert.Equal(t, duh.CodeBadRequest, itemErr.Code)
+}
+
+func TestProduceRaw(t *testing.T) {
+	for _, name := range queue.Patterns() {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, queue.Config{})
+			p, err := queue.New(name, queue.BatcherConfig{Client: s.Client(t)})
+			require.NoError(t, err)
+			defer func() { _ = p.Close(context.Background()) }()
+			raw, ok := p.(queue.RawProducer)
+			if !ok {
+				t.Skip("pattern does not implement queue.RawProducer")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			require.NoError(t, raw.ProduceRaw(ctx, produceRequest("one", "two")))
+
+			// Results are returned to the request which carried the item
+			var itemErr *queue.ItemError
+			require.True(t, errors.As(raw.ProduceRaw(ctx, produceRequest("three", "")), &itemErr))
+			assert.Equal(t, 1, itemErr.Index)
+
+			require.NoError(t, p.Close(ctx))
+			assert.Equal(t, []string{"one", "two", "three", ""}, s.Items())
+		})
+	}
+}
+
+func TestProduceRawMixed(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+	p, err := queue.NewMutex(queue.BatcherConfig{
+		Client: s.Client(t),
+		// Only flush when closed
+		FlushInterval: time.Minute,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	f := p.ProduceItemsAsync(ctx, produceRequest("one"))
+	done := make(chan error, 1)
+	go func() { done <- p.ProduceRaw(ctx, produceRequest("two", "three")) }()
+	require.Eventually(t, func() bool {
+		return gatherMetrics(t, p)["queue_depth"] == 2
+	}, time.Second, time.Millisecond)
+	g := p.ProduceItemsAsync(ctx, produceRequest("four"))
+
+	// Requests which were not encoded by the caller are encoded by the writer
+	require.NoError(t, p.Close(ctx))
+	require.NoError(t, f.Wait(ctx))
+	require.NoError(t, g.Wait(ctx))
+	require.NoError(t, <-done)
+	assert.Equal(t, [][]string{{"one", "two", "three", "four"}}, s.Batches())
+}
@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"sync"
+)
+
+// Producer is implemented by the Client and every queue pattern in this repo
+type Producer interface {
+	// ProduceItems sends the items to the server and blocks until they are
+	// written or ctx is cancelled.
+	ProduceItems(ctx context.Context, req *pb.ProduceRequest) error
+	// Close stops accepting new requests and sends the requests already queued.
+	// Once ctx is done, the batch in flight is cancelled and the requests which
+	// were not sent are failed with the ctx error, which Close returns.
+	Close(ctx context.Context) error
+}
+
+// TryProducer is implemented by every queue pattern in this repo which can reject
+// a request when the queue is full instead of blocking the caller.
+type TryProducer interface {
+	Producer
+	// TryProduceItems is identical to ProduceItems except it returns ErrQueueFull
+	// instead of waiting for room when the queue is full.
+	TryProduceItems(ctx context.Context, req *pb.ProduceRequest) error
+}
+
+// AsyncProducer is implemented by every queue pattern in this repo which allows
+// the caller to queue a request without waiting for it to be sent.
+type AsyncProducer interface {
+	Producer
+	// ProduceItemsAsync queues the request and returns a future which completes
+	// once the request is sent.
+	ProduceItemsAsync(ctx context.Context, req *pb.ProduceRequest) *ProduceFuture
+	// ProduceItemsFunc queues the request and calls fn once the request completes
+	ProduceItemsFunc(ctx context.Context, req *pb.ProduceRequest, fn func(err error))
+}
+
+// RawProducer is implemented by the queue patterns which allow the caller to encode
+// the items of a request on its own goroutine, such that the writer only appends
+// the encoded items to the batch. See EncodeItems()
+type RawProducer interface {
+	Producer
+	// ProduceRaw is identical to ProduceItems except the items are encoded by
+	// the caller instead of the writer
+	ProduceRaw(ctx context.Context, req *pb.ProduceRequest) error
+}
+
+// NewFunc creates a new Producer which sends items to the server using conf.Client
+type NewFunc func(conf BatcherConfig) (Producer, error)
+
+var registry = struct {
+	sync.RWMutex
+	names    []string
+	patterns map[string]NewFunc
+}{
+	patterns: make(map[string]NewFunc),
+}
+
+func init() {
+	Register("none", func(conf BatcherConfig) (Producer, error) {
+		if err := conf.validate(); err != nil {
+			return nil, err
+		}
+		return conf.Client, nil
+	})
+	Register("mutex", func(conf BatcherConfig) (Producer, error) { return NewMutex(conf) })
+	Register("mutex-locked", func(conf BatcherConfig) (Producer, error) { return NewMutexLocked(conf) })
+	Register("channel", func(conf BatcherConfig) (Producer, error) { return NewChannel(conf) })
+	Register("querator", func(conf BatcherConfig) (Producer, error) { return NewQuerator(conf) })
+	Register("querator-noalloc", func(conf BatcherConfig) (Producer, error) { return NewQueratorNoAlloc(conf) })
+	Register("ringbuffer", func(conf BatcherConfig) (Producer, error) { return NewRingBuffer(conf) })
+	Register("querator-pipelined", func(conf BatcherConfig) (Producer, error) { return NewQueratorPipelined(conf) })
+	Register("sharded", func(conf BatcherConfig) (Producer, error) { return NewSharded(conf) })
+	Register("prioritized", func(conf BatcherConfig) (Producer, error) { return NewPrioritized(conf) })
+	Register("fair", func(conf BatcherConfig) (Producer, error) { return NewFair(conf) })
+	Register("mpsc", func(conf BatcherConfig) (Producer, error) { return NewMPSC(conf) })
+	Register("combiner", func(conf BatcherConfig) (Producer, error) { return NewCombiner(conf) })
+	Register("striped", func(conf BatcherConfig) (Producer, error) { return NewStriped(conf) })
+}
+
+// Register makes a queue pattern available by name. If Register is called twice
+// with the same name, the previous pattern is replaced.
+func Register(name string, fn NewFunc) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, ok := registry.patterns[name]; !ok {
+		registry.names = append(registry.names, name)
+	}
+	registry.patterns[name] = fn
+}
+
+// New creates a new Producer using the queue pattern registered under the provided name
+func New(name string, conf BatcherConfig) (Producer, error) {
+	registry.RLock()
+	fn, ok := registry.patterns[name]
+	registry.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown queue pattern '%s'", name)
+	}
+	return fn(conf)
+}
+
+// Patterns returns the names of all the registered queue patterns in the order
+// they were registered.
+func Patterns() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+	return append([]string(nil), registry.names...)
+}
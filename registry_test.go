@@ -0,0 +1,50 @@
+package queue_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"testing"
+	"time"
+)
+
+func TestPatterns(t *testing.T) {
+	s, err := queue.NewServer(context.Background(), queue.Config{
+		ListenAddress: "localhost:0",
+		RequestSleep:  time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer func() { _ = s.Shutdown(context.Background()) }()
+	c := s.MustClient()
+
+	items := generateProduceItems(10)
+
+	for _, name := range queue.Patterns() {
+		t.Run(name, func(t *testing.T) {
+			p, err := queue.New(name, queue.BatcherConfig{Client: c, BatchLimit: 100})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			require.NoError(t, p.ProduceItems(ctx, &pb.ProduceRequest{Items: items}))
+			require.NoError(t, p.Close(ctx))
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := queue.New("unknown", queue.BatcherConfig{Client: c})
+		assert.ErrorContains(t, err, "unknown queue pattern 'unknown'")
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		for _, name := range queue.Patterns() {
+			_, err := queue.New(name, queue.BatcherConfig{})
+			assert.ErrorContains(t, err, "conf.Client is nil")
+
+			_, err = queue.New(name, queue.BatcherConfig{Client: c, BatchLimit: -1})
+			assert.ErrorContains(t, err, "conf.BatchLimit is invalid")
+		}
+	})
+}
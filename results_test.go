@@ -0,0 +1,89 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/duh-rpc/duh-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProduceResponse(t *testing.T) {
+	s := newTestServer(t, queue.Config{RequestSleep: time.Millisecond})
+	c := s.Client(t)
+
+	var res pb.ProduceResponse
+	err := c.ProduceItemsWithResponse(context.Background(), produceRequest("one", "", "three"), &res)
+	require.NoError(t, err)
+	require.Len(t, res.Results, 3)
+
+	assert.Equal(t, int32(duh.CodeOK), res.Results[0].Code)
+	assert.Equal(t, int64(1), res.Results[0].Offset)
+	assert.Equal(t, int32(duh.CodeBadRequest), res.Results[1].Code)
+	assert.Equal(t, "item bytes cannot be empty", res.Results[1].Message)
+	assert.Equal(t, int32(duh.CodeOK), res.Results[2].Code)
+	assert.Equal(t, int64(2), res.Results[2].Offset)
+
+	err = c.ProduceItems(context.Background(), produceRequest("one", ""))
+	var itemErr *queue.ItemError
+	require.True(t, errors.As(err, &itemErr))
+	assert.Equal(t, 1, itemErr.Index)
+	assert.Equal(t, duh.CodeBadRequest, itemErr.Code)
+}
+
+func TestPartialFailure(t *testing.T) {
+	for _, name := range queue.Patterns() {
+		if name == "none" {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, queue.Config{RequestSleep: time.Millisecond})
+
+			p, err := queue.New(name, queue.BatcherConfig{
+				Client:        s.Client(t),
+				FlushInterval: time.Minute,
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var wg sync.WaitGroup
+			errs := make([]error, 10)
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					item := fmt.Sprintf("item-%d", i)
+					// Poison the request from the 5th caller
+					if i == 5 {
+						item = ""
+					}
+					errs[i] = p.ProduceItems(ctx, produceRequest(item))
+				}(i)
+			}
+
+			// Wait for the producers to queue their requests
+			time.Sleep(100 * time.Millisecond)
+			require.NoError(t, p.Close(ctx))
+			wg.Wait()
+
+			for i, err := range errs {
+				if i == 5 {
+					var itemErr *queue.ItemError
+					require.True(t, errors.As(err, &itemErr))
+					assert.Equal(t, duh.CodeBadRequest, itemErr.Code)
+					continue
+				}
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
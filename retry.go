@@ -0,0 +1,125 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"github.com/duh-rpc/duh-go"
+	"github.com/kapetan-io/tackle/clock"
+	"github.com/kapetan-io/tackle/set"
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultInitialBackoff = 10 * time.Millisecond
+	DefaultMaxBackoff     = time.Second
+)
+
+// RetryPolicy controls how failed sends to the server are retried. The zero value
+// disables retries.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first. A value
+	// of 1 disables retries (Default: 1)
+	MaxAttempts int
+	// InitialBackoff is the backoff before the first retry, each retry after
+	// doubles the backoff (Default: 10ms)
+	InitialBackoff time.Duration
+	// MaxBackoff is the maximum backoff between retries (Default: 1s)
+	MaxBackoff time.Duration
+	// Retryable returns true if the error is a transient failure which should be
+	// retried (Default: IsRetryable)
+	Retryable func(error) bool
+}
+
+func (p *RetryPolicy) validate() error {
+	set.Default(&p.MaxAttempts, 1)
+	set.Default(&p.InitialBackoff, DefaultInitialBackoff)
+	set.Default(&p.MaxBackoff, DefaultMaxBackoff)
+	if p.Retryable == nil {
+		p.Retryable = IsRetryable
+	}
+
+	if p.MaxAttempts < 0 {
+		return errors.New("conf.Retry.MaxAttempts is invalid; must be greater than zero")
+	}
+	if p.InitialBackoff < 0 {
+		return errors.New("conf.Retry.InitialBackoff is invalid; must be greater than zero")
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		return errors.New("conf.Retry.MaxBackoff is invalid; must be greater than InitialBackoff")
+	}
+	return nil
+}
+
+// do calls fn until it succeeds, returns an error which is not retryable, or
+// MaxAttempts is reached. No retry is attempted if the backoff would
+// exceed the deadline of the provided ctx.
+func (p *RetryPolicy) do(ctx context.Context, fn func(context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= p.MaxAttempts || !p.Retryable(err) {
+			return err
+		}
+
+		backoff := p.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && clock.Until(deadline) < backoff {
+			return err
+		}
+
+		timer := clock.NewTimer(backoff)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// backoff returns the exponential backoff for the attempt with "equal jitter"
+// applied, such that the backoff is between half and the full exponential backoff.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt && backoff < p.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+
+	half := int64(backoff / 2)
+	if half <= 0 {
+		return backoff
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// IsRetryable returns true if the error is a transient failure such as a timeout,
+// a transport failure, a 429 or a 5xx code from the server. Errors caused by
+// the request itself, or by the callers ctx being cancelled, are never retried.
+func IsRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrClosed) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var e duh.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	switch e.Code() {
+	case duh.CodeTooManyRequests, duh.CodeRetryRequest:
+		return true
+	case duh.CodeClientError:
+		// Client errors which occurred while talking to the server are transport
+		// failures such as a timeout or a refused connection.
+		_, ok := e.Details()[duh.DetailsHttpUrl]
+		return ok
+	case duh.CodeNotImplemented:
+		return false
+	}
+	return e.Code() >= 500
+}
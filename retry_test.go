@@ -0,0 +1,164 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/duh-rpc/duh-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{err: errors.New("unknown"), retryable: false},
+		{err: context.Canceled, retryable: false},
+		{err: context.DeadlineExceeded, retryable: true},
+		{err: queue.ErrClosed, retryable: false},
+		{err: duh.NewServiceError(duh.CodeBadRequest, "bad", nil, nil), retryable: false},
+		{err: duh.NewServiceError(duh.CodeConflict, "conflict", nil, nil), retryable: false},
+		{err: duh.NewServiceError(duh.CodeTooManyRequests, "slow down", nil, nil), retryable: true},
+		{err: duh.NewServiceError(duh.CodeRetryRequest, "retry", nil, nil), retryable: true},
+		{err: duh.NewServiceError(duh.CodeInternalError, "oops", nil, nil), retryable: true},
+		{err: duh.NewServiceError(duh.CodeNotImplemented, "nope", nil, nil), retryable: false},
+		{err: duh.NewServiceError(503, "unavailable", nil, nil), retryable: true},
+		{err: duh.NewClientError("while marshaling", nil, nil), retryable: false},
+		{
+			err: duh.NewClientError("during client.Do(): %w", errors.New("connection refused"),
+				map[string]string{duh.DetailsHttpUrl: "http://localhost/produce"}),
+			retryable: true,
+		},
+	} {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			assert.Equal(t, tc.retryable, queue.IsRetryable(tc.err))
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	retry := queue.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	for _, name := range queue.Patterns() {
+		t.Run(name, func(t *testing.T) {
+			s := newTestServer(t, queue.Config{RequestSleep: time.Millisecond})
+			conf := s.ClientConfig()
+			conf.Retry = retry
+			c, err := queue.NewClient(conf)
+			require.NoError(t, err)
+
+			p, err := queue.New(name, queue.BatcherConfig{
+				Client: c,
+				// The patterns retry with the policy of the Client
+				FlushInterval: time.Millisecond,
+			})
+			require.NoError(t, err)
+			defer func() { _ = p.Close(context.Background()) }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			t.Run("Retryable", func(t *testing.T) {
+				s.FailNext(2, duh.CodeTooManyRequests)
+				require.NoError(t, p.ProduceItems(ctx, produceRequest("retryable")))
+				assert.Equal(t, []string{"retryable"}, s.Items())
+			})
+
+			t.Run("MaxAttempts", func(t *testing.T) {
+				s.FailNext(3, duh.CodeInternalError)
+				err := p.ProduceItems(ctx, produceRequest("max-attempts"))
+				var e duh.Error
+				require.True(t, errors.As(err, &e))
+				assert.Equal(t, duh.CodeInternalError, e.Code())
+			})
+
+			t.Run("Permanent", func(t *testing.T) {
+				requests := s.Requests()
+				s.FailNext(1, duh.CodeBadRequest)
+				err := p.ProduceItems(ctx, produceRequest("permanent"))
+				var e duh.Error
+				require.True(t, errors.As(err, &e))
+				assert.Equal(t, duh.CodeBadRequest, e.Code())
+				assert.Equal(t, requests+1, s.Requests())
+			})
+		})
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	s := newTestServer(t, queue.Config{RequestSleep: time.Millisecond})
+	s.FailNext(100, duh.CodeInternalError)
+
+	p, err := queue.NewQuerator(queue.BatcherConfig{
+		Client: s.Client(t),
+		Retry: queue.RetryPolicy{
+			MaxAttempts:    100,
+			InitialBackoff: 10 * time.Millisecond,
+			MaxBackoff:     10 * time.Millisecond,
+		},
+	})
+	require.NoError(t, err)
+	defer func() { _ = p.Close(context.Background()) }()
+
+	// The batch should never be retried past the deadline of the caller
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Error(t, p.ProduceItems(ctx, produceRequest("item")))
+	assert.Less(t, time.Since(start), time.Second)
+
+	// Wait for the batch to be abandoned
+	time.Sleep(50 * time.Millisecond)
+	assert.Less(t, s.Requests(), 20, fmt.Sprintf("requests: %d", s.Requests()))
+}
+
+func TestRetryDeadlineLatest(t *testing.T) {
+	s := newTestServer(t, queue.Config{RequestSleep: time.Millisecond})
+	s.FailNext(1000, duh.CodeInternalError)
+
+	p, err := queue.NewMutex(queue.BatcherConfig{
+		Client:         s.Client(t),
+		FlushInterval:  50 * time.Millisecond,
+		DeadlinePolicy: queue.DeadlineLatest,
+		Retry: queue.RetryPolicy{
+			MaxAttempts:    1000,
+			InitialBackoff: 10 * time.Millisecond,
+			MaxBackoff:     10 * time.Millisecond,
+		},
+	})
+	require.NoError(t, err)
+	defer func() { _ = p.Close(context.Background()) }()
+
+	short, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	long, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Both requests are sent in the same batch, which is retried until the latest deadline
+	start := time.Now()
+	shortErr, longErr := make(chan error, 1), make(chan error, 1)
+	p.ProduceItemsFunc(short, produceRequest("short"), func(err error) { shortErr <- err })
+	p.ProduceItemsFunc(long, produceRequest("long"), func(err error) { longErr <- err })
+
+	// The request whose deadline expired is completed between attempts, instead of
+	// being held until the latest deadline
+	select {
+	case err := <-shortErr:
+		assert.ErrorIs(t, err, queue.ErrCommitted)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Less(t, time.Since(start), time.Second)
+	case <-time.After(3 * time.Second):
+		t.Fatal("expired request was held by the retries of the batch")
+	}
+
+	// The request which remains succeeds once the server recovers, without the items
+	// of the expired request
+	s.FailNext(0, 0)
+	require.NoError(t, <-longErr)
+	assert.Equal(t, []string{"long"}, s.Items())
+}
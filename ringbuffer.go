@@ -0,0 +1,20 @@
+package queue
+
+import (
+	"github.com/thrawn01/queue-patterns.go/batch"
+)
+
+// RingBuffer publishes each request into a lock free ring buffer which a writer
+// sends in a batch as soon as it is able to. The ring holds RequestBufferSize
+// requests rounded up to the next power of two.
+type RingBuffer struct {
+	collector
+}
+
+func NewRingBuffer(conf BatcherConfig) (*RingBuffer, error) {
+	m := &RingBuffer{}
+	if err := m.init(conf, batch.Ring); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,173 @@
+package queue
+
+import (
+	"context"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"google.golang.org/protobuf/proto"
+	"sync"
+	"time"
+)
+
+// sender is reused by a writer to send each of its batches, such that sending a
+// batch does not allocate once the buffers of the sender have grown to the size
+// of a batch. A sender only sends a single batch at a time.
+type sender struct {
+	exchange
+	// batch holds the items of the batch being sent, unless encoded by callers
+	batch pb.ProduceRequest
+	res   pb.ProduceResponse
+	ctx   batchCtx
+	// conf and requests are of the batch being sent, and attempts is the number
+	// of attempts made at sending it
+	conf     BatcherConfig
+	requests []*Request
+	attempts int
+	// attempt and encode are sendOnce() and appendBatch(), created once
+	attempt func(ctx context.Context) error
+	encode  func(buf []byte) ([]byte, error)
+}
+
+// sendOnce makes a single attempt at sending the batch. Before each retry, requests
+// whose context is done are completed and left out of the batch, such that their
+// callers are not held until the deadline of the batch.
+func (s *sender) sendOnce(ctx context.Context) error {
+	if s.attempts++; s.attempts > 1 {
+		if s.requests = expire(s.conf, s.requests); len(s.requests) == 0 {
+			s.res.Results = s.res.Results[:0]
+			return nil
+		}
+	}
+
+	var items int
+	for _, req := range s.requests {
+		items += len(req.Request.Items)
+	}
+	return s.conf.Client.roundTrip(ctx, &s.exchange, items, &s.res, s.encode)
+}
+
+// appendBatch appends the batch to buf. If any request carries items encoded by
+// its caller, the encoded items are appended instead of marshaling the batch.
+func (s *sender) appendBatch(buf []byte) ([]byte, error) {
+	if hasRaw(s.requests) {
+		return appendRaw(buf, s.requests)
+	}
+
+	s.batch.Items = s.batch.Items[:0]
+	for _, req := range s.requests {
+		s.batch.Items = append(s.batch.Items, req.Request.Items...)
+	}
+	return proto.MarshalOptions{}.MarshalAppend(buf, &s.batch)
+}
+
+// batchCtx is the context of each batch a sender sends. Rather than deriving a
+// context with a deadline for every batch, the context is reset for each batch,
+// and only starts a timer once something waits on Done().
+type batchCtx struct {
+	mutex    sync.Mutex
+	parent   context.Context
+	deadline time.Time
+	done     chan struct{}
+	err      error
+	timer    *time.Timer
+	stop     func() bool
+}
+
+// reset prepares the context for a batch which must be sent before the deadline
+func (c *batchCtx) reset(parent context.Context, deadline time.Time) {
+	if d, ok := parent.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.mutex.Lock()
+	c.parent, c.deadline, c.done, c.err = parent, deadline, nil, nil
+	c.mutex.Unlock()
+}
+
+// release cancels the context once the batch has been sent
+func (c *batchCtx) release() {
+	c.mutex.Lock()
+	c.cancel(context.Canceled)
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	stop := c.stop
+	c.stop = nil
+	c.mutex.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+}
+
+func (c *batchCtx) Deadline() (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.deadline, true
+}
+
+func (c *batchCtx) Done() <-chan struct{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.done != nil {
+		return c.done
+	}
+
+	c.done = make(chan struct{})
+	if c.check() != nil {
+		close(c.done)
+		return c.done
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(time.Until(c.deadline), c.expire)
+	} else {
+		c.timer.Reset(time.Until(c.deadline))
+	}
+	c.stop = context.AfterFunc(c.parent, c.expire)
+	return c.done
+}
+
+func (c *batchCtx) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.check()
+}
+
+func (c *batchCtx) Value(key any) any {
+	c.mutex.Lock()
+	parent := c.parent
+	c.mutex.Unlock()
+	return parent.Value(key)
+}
+
+// expire is called once the deadline has passed or the parent is done. As the
+// timer may fire once the context was reset for the next batch, the context is
+// only cancelled if the deadline or parent of the current batch calls for it.
+func (c *batchCtx) expire() {
+	c.mutex.Lock()
+	_ = c.check()
+	c.mutex.Unlock()
+}
+
+// check cancels the context if the parent is done or the deadline has passed, and
+// returns the error of the context. The mutex must be held.
+func (c *batchCtx) check() error {
+	if c.err == nil {
+		if err := c.parent.Err(); err != nil {
+			c.cancel(err)
+		} else if !time.Now().Before(c.deadline) {
+			c.cancel(context.DeadlineExceeded)
+		}
+	}
+	return c.err
+}
+
+// cancel cancels the context with err unless already cancelled. The mutex must
+// be held.
+func (c *batchCtx) cancel(err error) {
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	if c.done != nil {
+		close(c.done)
+	}
+}
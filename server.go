@@ -48,7 +48,10 @@ type Server struct {
 	server     *http.Server
 	wg         sync.WaitGroup
 	Listener   net.Listener
-	conf       Config
+	// Registry is the prometheus registry served at /metrics. Batchers may register
+	// with it to have their metrics served alongside the metrics of the server.
+	Registry *prometheus.Registry
+	conf     Config
 }
 
 func NewServer(ctx context.Context, conf Config) (*Server, error) {
@@ -62,12 +65,12 @@ func NewServer(ctx context.Context, conf Config) (*Server, error) {
 }
 
 func (s *Server) Start(ctx context.Context) error {
-	registry := prometheus.NewRegistry()
+	s.Registry = prometheus.NewRegistry()
 
 	handler := NewHTTPHandler(promhttp.InstrumentMetricHandler(
-		registry, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+		s.Registry, promhttp.HandlerFor(s.Registry, promhttp.HandlerOpts{}),
 	), s.conf)
-	registry.MustRegister(handler)
+	s.Registry.MustRegister(handler)
 
 	if s.conf.ServerTLS() != nil {
 		if err := s.spawnHTTPS(ctx, handler); err != nil {
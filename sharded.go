@@ -0,0 +1,182 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kapetan-io/tackle/clock"
+	"github.com/kapetan-io/tackle/set"
+	"github.com/thrawn01/queue-patterns.go/batch"
+	"time"
+)
+
+// ErrKeyFailed is returned by the Sharded pattern along with the error of the batch
+// when a batch which carried an earlier item with the same key failed. Such requests
+// are failed instead of sent, such that the items of a key never reach the server
+// out of order.
+var ErrKeyFailed = errors.New("an earlier batch with the same key failed")
+
+// Sharded hashes the key of each item onto one of conf.Shards independent Querator
+// style writers. Each shard sends one batch at a time and retries a failed batch
+// before sending the next, such that items with the same key reach the server in
+// the order they were produced, while items with different keys are sent in
+// parallel. A request whose items have different keys is split across the shards,
+// and completes once every shard has sent its part.
+//
+// MaxQueuedBytes applies to each shard. See WithNoTLSConns() to allow a connection
+// for each shard.
+type Sharded struct {
+	producer
+	shards []*collector
+	conf   BatcherConfig
+}
+
+func NewSharded(conf BatcherConfig) (*Sharded, error) {
+	set.Default(&conf.Shards, DefaultShards)
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+
+	m := &Sharded{shards: make([]*collector, conf.Shards), conf: conf}
+	m.producer = newProducer(&m.conf, m.put)
+	// Each shard limits the bytes queued in the shard
+	m.limiter = nil
+	for i := range m.shards {
+		c := conf
+		c.order = &keyOrder{failed: make(map[string]keyFailure)}
+		m.shards[i] = &collector{}
+		if err := m.shards[i].init(c, batch.Querator); err != nil {
+			_ = m.Close(context.Background())
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// shard returns the index of the shard which owns the key
+func (m *Sharded) shard(key string) int {
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(len(m.shards)))
+}
+
+// put queues the request on the shard which owns the keys of its items, or splits
+// the request into a part for each shard which owns any of its keys.
+func (m *Sharded) put(r *Request, block bool) error {
+	var first int
+	var parts map[int][]int
+	for i, item := range r.Request.Items {
+		n := m.shard(item.Key)
+		if i == 0 {
+			first = n
+			continue
+		}
+		if parts == nil && n == first {
+			continue
+		}
+		if parts == nil {
+			parts = map[int][]int{first: make([]int, 0, len(r.Request.Items))}
+			for j := 0; j < i; j++ {
+				parts[first] = append(parts[first], j)
+			}
+		}
+		parts[n] = append(parts[n], i)
+	}
+	if parts == nil {
+		return m.shards[first].enqueue(r, block)
+	}
+
+	shards := make([]int, 0, len(parts))
+	indexes := make([][]int, 0, len(parts))
+	for n, part := range parts {
+		shards = append(shards, n)
+		indexes = append(indexes, part)
+	}
+	return newSplit(r, len(indexes)).enqueue(indexes, func(i int, part *Request) error {
+		return m.shards[shards[i]].enqueue(part, block)
+	})
+}
+
+// Close closes every shard in turn
+func (m *Sharded) Close(ctx context.Context) error {
+	var result error
+	for _, s := range m.shards {
+		// Skip shards which failed to initialize
+		if s == nil || s.queue == nil {
+			continue
+		}
+		if err := s.Close(ctx); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// keyFailure is the failure of a batch which carried an item with the key
+type keyFailure struct {
+	at  time.Time
+	err error
+}
+
+// keyOrder remembers the keys of each batch a shard failed to send, such that the
+// requests for a key which were queued before the batch failed are failed as well,
+// instead of being sent after the items of the key which never reached the server.
+// Only used by the writer of the shard.
+type keyOrder struct {
+	failed map[string]keyFailure
+}
+
+// fail records the keys of the requests in a batch which failed
+func (o *keyOrder) fail(requests []*Request, err error) {
+	now := clock.Now()
+	for _, r := range requests {
+		for _, item := range r.Request.Items {
+			o.failed[item.Key] = keyFailure{at: now, err: err}
+		}
+	}
+}
+
+// hold fails each request with an item whose key failed after the request was
+// queued, and returns the requests which remain. The requests slice is modified
+// in place.
+func (o *keyOrder) hold(conf BatcherConfig, requests []*Request) []*Request {
+	if len(o.failed) == 0 {
+		return requests
+	}
+
+	remain := requests[:0]
+	for _, r := range requests {
+		if err := o.check(r); err != nil {
+			conf.metrics.unqueued()
+			conf.metrics.failed("send")
+			r.complete(err)
+			continue
+		}
+		remain = append(remain, r)
+	}
+
+	// As the requests are flushed in the order they were queued, a failure before
+	// the oldest request which remains can no longer fail a request.
+	if len(remain) != 0 {
+		for key, f := range o.failed {
+			if f.at.Before(remain[0].queued) {
+				delete(o.failed, key)
+			}
+		}
+	}
+	return remain
+}
+
+// check returns ErrKeyFailed if a key of the request failed after it was queued
+func (o *keyOrder) check(r *Request) error {
+	for _, item := range r.Request.Items {
+		if f, ok := o.failed[item.Key]; ok && !r.queued.After(f.at) {
+			return fmt.Errorf("%w; key '%s'; %w", ErrKeyFailed, item.Key, f.err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/duh-rpc/duh-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardedOrder(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+	// Vary the time each batch takes, such that shards complete out of order
+	s.SetDelay(func([]string) time.Duration {
+		return time.Duration(rand.Intn(5)) * time.Millisecond
+	})
+	// Fail batches such that they must be retried
+	s.FailNext(5, duh.CodeInternalError)
+
+	c, err := queue.NewClient(queue.WithNoTLSConns(strings.TrimPrefix(s.URL, "http://"), 8))
+	require.NoError(t, err)
+
+	p, err := queue.NewSharded(queue.BatcherConfig{
+		Client: c,
+		Shards: 8,
+		Retry:  queue.RetryPolicy{MaxAttempts: 10, InitialBackoff: time.Millisecond},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const keys, items = 20, 50
+	var wg sync.WaitGroup
+	for k := 0; k < keys; k++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			// Queue every item for the key without waiting for the previous to be sent
+			var futures []*queue.ProduceFuture
+			for i := 0; i < items; i++ {
+				futures = append(futures, p.ProduceItemsAsync(ctx, &pb.ProduceRequest{
+					Items: []*pb.ProduceItem{{Key: key, Bytes: []byte(fmt.Sprintf("%s:%d", key, i))}},
+				}))
+			}
+			for _, f := range futures {
+				assert.NoError(t, f.Wait(ctx))
+			}
+		}(fmt.Sprintf("key-%d", k))
+	}
+	wg.Wait()
+	require.NoError(t, p.Close(ctx))
+
+	// Every item for a key must be received in the order it was produced
+	next := make(map[string]int)
+	for _, item := range s.Items() {
+		key, seq, _ := strings.Cut(item, ":")
+		i, err := strconv.Atoi(seq)
+		require.NoError(t, err)
+		require.Equal(t, next[key], i, "item '%s' out of order", item)
+		next[key]++
+	}
+	assert.Len(t, next, keys)
+	for key, n := range next {
+		assert.Equal(t, items, n, key)
+	}
+	// Shards send in parallel
+	assert.Greater(t, s.MaxInFlight(), 1)
+}
+
+func TestShardedMixedKeys(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+
+	p, err := queue.NewSharded(queue.BatcherConfig{Client: s.Client(t), Shards: 8})
+	require.NoError(t, err)
+	defer func() { _ = p.Close(context.Background()) }()
+
+	// The request is split across the shards which own its keys
+	req := &pb.ProduceRequest{}
+	var items []string
+	for i := 0; i < 20; i++ {
+		item := fmt.Sprintf("item-%d", i)
+		req.Items = append(req.Items, &pb.ProduceItem{Key: fmt.Sprintf("key-%d", i), Bytes: []byte(item)})
+		items = append(items, item)
+	}
+	require.NoError(t, p.ProduceItems(context.Background(), req))
+	assert.ElementsMatch(t, items, s.Items())
+	assert.Greater(t, len(s.Batches()), 1)
+
+	// An item rejected by the server is reported at its index in the request
+	req.Items[7].Bytes = nil
+	err = p.ProduceItems(context.Background(), req)
+	var e *queue.ItemError
+	require.True(t, errors.As(err, &e))
+	assert.Equal(t, 7, e.Index)
+}
+
+func TestShardedKeyFailed(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+
+	// Hold the first batch, such that the next requests are queued behind it
+	release := make(chan struct{})
+	s.SetDelay(func(batch []string) time.Duration {
+		if batch[0] == "hold" {
+			<-release
+		}
+		return 0
+	})
+
+	p, err := queue.NewSharded(queue.BatcherConfig{
+		Client:     s.Client(t),
+		Shards:     1,
+		BatchLimit: 1,
+		// Queue the requests without waiting for the held batch
+		RequestBufferSize: 10,
+	})
+	require.NoError(t, err)
+	defer func() { _ = p.Close(context.Background()) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	keyed := func(key, item string) *pb.ProduceRequest {
+		return &pb.ProduceRequest{Items: []*pb.ProduceItem{{Key: key, Bytes: []byte(item)}}}
+	}
+	hold := p.ProduceItemsAsync(ctx, keyed("c", "hold"))
+	require.Eventually(t, func() bool { return s.Requests() == 1 }, time.Second, time.Millisecond)
+	a0 := p.ProduceItemsAsync(ctx, keyed("a", "a-0"))
+	a1 := p.ProduceItemsAsync(ctx, keyed("a", "a-1"))
+	b0 := p.ProduceItemsAsync(ctx, keyed("b", "b-0"))
+
+	// The batch which carries a-0 fails permanently
+	s.FailNext(1, duh.CodeBadRequest)
+	close(release)
+	require.NoError(t, hold.Wait(ctx))
+	var e duh.Error
+	require.True(t, errors.As(a0.Wait(ctx), &e))
+	assert.Equal(t, duh.CodeBadRequest, e.Code())
+
+	// a-1 must not reach the server before a-0, so it fails along with a-0
+	err = a1.Wait(ctx)
+	assert.ErrorIs(t, err, queue.ErrKeyFailed)
+	require.True(t, errors.As(err, &e))
+	assert.Equal(t, duh.CodeBadRequest, e.Code())
+	require.NoError(t, b0.Wait(ctx))
+
+	// Requests for the key queued once the failure was reported are sent
+	require.NoError(t, p.ProduceItems(ctx, keyed("a", "a-2")))
+	assert.Equal(t, []string{"hold", "b-0", "a-2"}, s.Items())
+}
@@ -0,0 +1,105 @@
+package queue
+
+import (
+	"errors"
+	pb "github.com/thrawn01/queue-patterns.go/proto"
+	"sync"
+)
+
+// split is a request whose items are queued as parts, each of which is a request of
+// its own. The request completes once every part has completed. The request fails
+// with the error of the first part to fail, unless only items were rejected, in
+// which case the request fails with an *ItemError for the first rejected item.
+type split struct {
+	r        *Request
+	mutex    sync.Mutex
+	remain   int
+	err      error
+	rejected *ItemError
+}
+
+func newSplit(r *Request, parts int) *split {
+	return &split{r: r, remain: parts}
+}
+
+// part returns a request which carries the items of the request at the indexes. The
+// part is committed along with the request, such that the request is not withdrawn
+// by its caller once any of its parts has been committed.
+func (s *split) part(indexes []int) (*Request, error) {
+	req := &pb.ProduceRequest{
+		Items:    make([]*pb.ProduceItem, len(indexes)),
+		Priority: s.r.Request.Priority,
+		Tenant:   s.r.Request.Tenant,
+	}
+	for i, idx := range indexes {
+		req.Items[i] = s.r.Request.Items[idx]
+	}
+
+	p := newRequest(s.r.Context, req)
+	if s.r.raw != nil {
+		var err error
+		if p.raw, err = EncodeItems(nil, req.Items); err != nil {
+			return nil, err
+		}
+		p.size = len(p.raw)
+	}
+	p.queued = s.r.queued
+	p.parent = s.r
+	p.callback = func(err error) {
+		s.done(indexes, err)
+	}
+	return p, nil
+}
+
+// done records the error of a part, and completes the request once every part has
+// completed. The index of an item the part rejected is the index of the item in the
+// part, which is translated to the index of the item in the request.
+func (s *split) done(indexes []int, err error) {
+	s.mutex.Lock()
+	var itemErr *ItemError
+	if errors.As(err, &itemErr) {
+		if idx := indexes[itemErr.Index]; s.rejected == nil || idx < s.rejected.Index {
+			s.rejected = &ItemError{Index: idx, Code: itemErr.Code, Message: itemErr.Message}
+		}
+	} else if err != nil && s.err == nil {
+		s.err = err
+	}
+	s.remain--
+	last := s.remain == 0
+	s.mutex.Unlock()
+
+	if last {
+		if s.err == nil && s.rejected != nil {
+			s.err = s.rejected
+		}
+		s.r.complete(s.err)
+	}
+}
+
+// enqueue queues a part for each of the indexes in order with enqueue, which is
+// passed the index of the part. If a part could not be queued, the parts which
+// remain are failed with the same error, unless no part was queued, in which case
+// the error is returned.
+func (s *split) enqueue(parts [][]int, enqueue func(i int, part *Request) error) error {
+	for i, indexes := range parts {
+		part, err := s.part(indexes)
+		if err == nil {
+			err = enqueue(i, part)
+		}
+		if err != nil {
+			if i == 0 {
+				return err
+			}
+			s.fail(len(parts)-i, err)
+			return nil
+		}
+	}
+	return nil
+}
+
+// fail completes the parts which were never queued with err
+func (s *split) fail(parts int, err error) {
+	for i := 0; i < parts; i++ {
+		s.done(nil, err)
+	}
+}
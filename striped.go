@@ -0,0 +1,29 @@
+package queue
+
+import (
+	"github.com/thrawn01/queue-patterns.go/batch"
+)
+
+// Striped collects requests into one of several queues, each protected by its own
+// mutex. Each producer appends to the queue chosen by a token cached for the P it
+// is running on, such that producers rarely contend with each other for a mutex.
+// When any queue holds its share of a full batch, or the interval ticks, a single
+// writer sweeps every queue and sends the requests in the order they were queued.
+//
+// The number of queues is set by conf.Stripes. The depth of each queue is summed
+// when the metrics are collected, such that producers never touch a shared gauge.
+type Striped struct {
+	collector
+}
+
+func NewStriped(conf BatcherConfig) (*Striped, error) {
+	m := &Striped{}
+	if err := m.init(conf, batch.Striped); err != nil {
+		return nil, err
+	}
+	m.conf.metrics.length = func() int {
+		n, _ := m.queue.Len()
+		return n
+	}
+	return m, nil
+}
@@ -0,0 +1,89 @@
+package queue_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/thrawn01/queue-patterns.go"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStriped(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+
+	p, err := queue.NewStriped(queue.BatcherConfig{
+		Client:        s.Client(t),
+		BatchLimit:    50,
+		Stripes:       8,
+		FlushInterval: time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const producers, requests = 16, 100
+	var wg sync.WaitGroup
+	for id := 0; id < producers; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			futures := make([]*queue.ProduceFuture, 0, requests)
+			for i := 0; i < requests; i++ {
+				futures = append(futures, p.ProduceItemsAsync(ctx, produceRequest(fmt.Sprintf("%d/%d", id, i))))
+			}
+			for _, f := range futures {
+				assert.NoError(t, f.Wait(ctx))
+			}
+		}(id)
+	}
+	wg.Wait()
+	require.NoError(t, p.Close(ctx))
+
+	// Every item is sent once, and the requests of each producer are sent in the
+	// order they were queued, regardless of the stripe they were queued in
+	items := s.Items()
+	require.Len(t, items, producers*requests)
+	next := make(map[string]int)
+	for _, item := range items {
+		id, i, ok := strings.Cut(item, "/")
+		require.True(t, ok)
+		n, err := strconv.Atoi(i)
+		require.NoError(t, err)
+		assert.Equal(t, next[id], n, "producer '%s' items out of order", id)
+		next[id] = n + 1
+	}
+}
+
+func TestStripedDepth(t *testing.T) {
+	s := newTestServer(t, queue.Config{})
+
+	p, err := queue.NewStriped(queue.BatcherConfig{
+		Client:  s.Client(t),
+		Stripes: 4,
+		// Nothing is sent until Close()
+		FlushInterval: time.Minute,
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The depth of every stripe is summed when collected
+	var futures []*queue.ProduceFuture
+	for i := 0; i < 10; i++ {
+		futures = append(futures, p.ProduceItemsAsync(ctx, produceRequest(fmt.Sprintf("item-%d", i))))
+	}
+	assert.Equal(t, float64(10), gatherMetrics(t, p)["queue_depth"])
+
+	require.NoError(t, p.Close(ctx))
+	for _, f := range futures {
+		require.NoError(t, f.Wait(ctx))
+	}
+	assert.Equal(t, float64(0), gatherMetrics(t, p)["queue_depth"])
+}